@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// defaultBeta is the soft thresholding power used by Tesson et al. (beta1 in clustering.R)
+const defaultBeta = 6.0
+
+// rankVector returns the ranks of x, giving tied values their average rank (as R's rank() does)
+func rankVector(x []float64) []float64 {
+	n := len(x)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return x[order[i]] < x[order[j]]
+	})
+
+	ranks := make([]float64, n)
+	for i := 0; i < n; {
+		j := i
+		for j+1 < n && x[order[j+1]] == x[order[i]] {
+			j++
+		}
+		// Positions i..j are tied, so they all share the average of ranks i+1..j+1
+		avg := float64(i+j+2) / 2.0
+		for k := i; k <= j; k++ {
+			ranks[order[k]] = avg
+		}
+		i = j + 1
+	}
+	return ranks
+}
+
+// spearmanMatrix computes the gene by gene Spearman correlation matrix of data,
+// where rows are samples and columns are genes (the same layout as datC1 in R).
+// Every gene is ranked once and the correlations are taken between the ranks,
+// which gives the same values as ranking each pair of columns separately
+// but without re-sorting the samples for every pair.
+// Genes with zero variance get a correlation of 0 with every other gene.
+func spearmanMatrix(data *mat.Dense) *mat.SymDense {
+	rows, cols := data.Dims()
+	ranked := mat.NewDense(rows, cols, nil)
+	for j := 0; j < cols; j++ {
+		ranked.SetCol(j, rankVector(getColumn(data, j)))
+	}
+	return pearsonMatrix(ranked)
+}
+
+// pearsonMatrix computes the gene by gene Pearson correlation matrix of data (samples x genes).
+// Genes with zero variance get a correlation of 0 with every other gene.
+func pearsonMatrix(data *mat.Dense) *mat.SymDense {
+	rows, cols := data.Dims()
+	standardized := mat.NewDense(rows, cols, nil)
+
+	for j := 0; j < cols; j++ {
+		column := getColumn(data, j)
+
+		// Center the column and scale it to unit length so that the cross product is the correlation
+		mean := meanFloat(column)
+		var norm float64
+		for i := range column {
+			column[i] -= mean
+			norm += column[i] * column[i]
+		}
+		norm = math.Sqrt(norm)
+		for i := range column {
+			if norm != 0 {
+				column[i] /= norm
+			} else {
+				column[i] = 0
+			}
+		}
+		standardized.SetCol(j, column)
+	}
+
+	cor := mat.NewSymDense(cols, nil)
+	cor.SymOuterK(1, standardized.T())
+	return cor
+}
+
+// adjacencyMatrix computes the signed squared correlation sign(cor)*cor^2 used by DiffCoEx,
+// with the diagonal set to zero
+func adjacencyMatrix(cor *mat.SymDense) *mat.SymDense {
+	n := cor.SymmetricDim()
+	adj := mat.NewSymDense(n, nil)
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			c := cor.At(i, j)
+			if c < 0 {
+				adj.SetSym(i, j, -c*c)
+			} else {
+				adj.SetSym(i, j, c*c)
+			}
+		}
+	}
+	return adj
+}
+
+// differentialAdjacency computes the DiffCoEx differential matrix (|AdjC1-AdjC2|/2)^(beta/2)
+func differentialAdjacency(adjC1, adjC2 *mat.SymDense, beta float64) *mat.SymDense {
+	n := adjC1.SymmetricDim()
+	if adjC2.SymmetricDim() != n {
+		panic("Adjacency matrices must have the same dimensions")
+	}
+	diff := mat.NewSymDense(n, nil)
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d := math.Abs(adjC1.At(i, j)-adjC2.At(i, j)) / 2.0
+			diff.SetSym(i, j, math.Pow(d, beta/2.0))
+		}
+	}
+	return diff
+}
+
+// conditionAdjacency builds the DiffCoEx adjacency matrix for one condition (samples x genes)
+func conditionAdjacency(datC *mat.Dense) *mat.SymDense {
+	return adjacencyMatrix(spearmanMatrix(datC))
+}
+
+// readExpressionCSV reads a condition file written by saveToCSV
+// (one gene per row, gene ID in the first column, no header)
+func readExpressionCSV(filename string) (*DataWithGenes, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s contains no data", filename)
+	}
+
+	numCols := len(records[0]) - 1
+	geneIDs := make([]string, len(records))
+	data := mat.NewDense(len(records), numCols, nil)
+
+	for i, record := range records {
+		geneIDs[i] = record[0]
+		for j := 1; j < len(record); j++ {
+			value, err := strconv.ParseFloat(record[j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", filename, i+1, err)
+			}
+			data.Set(i, j-1, value)
+		}
+	}
+
+	return &DataWithGenes{Data: data, GeneIDs: geneIDs}, nil
+}
+
+// samplesByGenes transposes a genes x samples matrix into the samples x genes layout used by the analysis code
+func samplesByGenes(data *mat.Dense) *mat.Dense {
+	var t mat.Dense
+	t.CloneFrom(data.T())
+	return &t
+}
+
+// readConditions reads the two condition files and checks that they describe the same genes in the same order
+func readConditions(fileC1, fileC2 string) (*DataWithGenes, *DataWithGenes, error) {
+	dataC1, err := readExpressionCSV(fileC1)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataC2, err := readExpressionCSV(fileC2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(dataC1.GeneIDs) != len(dataC2.GeneIDs) {
+		return nil, nil, fmt.Errorf("%s has %d genes but %s has %d", fileC1, len(dataC1.GeneIDs), fileC2, len(dataC2.GeneIDs))
+	}
+	for i := range dataC1.GeneIDs {
+		if dataC1.GeneIDs[i] != dataC2.GeneIDs[i] {
+			return nil, nil, fmt.Errorf("gene %d differs between conditions: %s vs %s", i+1, dataC1.GeneIDs[i], dataC2.GeneIDs[i])
+		}
+	}
+	return dataC1, dataC2, nil
+}
+
+// saveMatrixCSV writes a square gene by gene matrix with gene IDs as the header row and first column
+func saveMatrixCSV(m mat.Matrix, geneIDs []string, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	header := make([]string, len(geneIDs)+1)
+	copy(header[1:], geneIDs)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	rows, cols := m.Dims()
+	for i := 0; i < rows; i++ {
+		row := make([]string, cols+1)
+		row[0] = geneIDs[i]
+		for j := 0; j < cols; j++ {
+			row[j+1] = strconv.FormatFloat(m.At(i, j), 'g', -1, 64)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMatrixCSV reads a square gene by gene matrix written by saveMatrixCSV
+func readMatrixCSV(filename string) (*mat.SymDense, []string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil, fmt.Errorf("%s contains no data", filename)
+	}
+
+	geneIDs := records[0][1:]
+	n := len(geneIDs)
+	if len(records)-1 != n {
+		return nil, nil, fmt.Errorf("%s is not square: %d columns but %d rows", filename, n, len(records)-1)
+	}
+
+	m := mat.NewSymDense(n, nil)
+	for i, record := range records[1:] {
+		if record[0] != geneIDs[i] {
+			return nil, nil, fmt.Errorf("%s: row %d is %s but column %d is %s", filename, i+1, record[0], i+1, geneIDs[i])
+		}
+		for j := i; j < n; j++ {
+			value, err := strconv.ParseFloat(record[j+1], 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s line %d: %v", filename, i+2, err)
+			}
+			m.SetSym(i, j, value)
+		}
+	}
+
+	return m, geneIDs, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+func TestRankVectorTies(t *testing.T) {
+	got := rankVector([]float64{3, 1, 3, 2})
+	want := []float64{3.5, 1, 3.5, 2}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("rankVector() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSpearmanMatrixMatchesRankCorrelation(t *testing.T) {
+	// 6 samples x 4 genes
+	data := mat.NewDense(6, 4, []float64{
+		1.2, 3.1, 0.5, 2.0,
+		2.4, 2.9, 0.7, 1.0,
+		3.1, 2.5, 0.2, 4.0,
+		4.8, 1.7, 0.9, 3.0,
+		5.0, 1.1, 0.1, 6.0,
+		6.3, 0.4, 0.8, 5.0,
+	})
+
+	cor := spearmanMatrix(data)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			want := stat.Correlation(rankVector(getColumn(data, i)), rankVector(getColumn(data, j)), nil)
+			if math.Abs(cor.At(i, j)-want) > 1e-12 {
+				t.Errorf("cor[%d][%d] = %v, want %v", i, j, cor.At(i, j), want)
+			}
+		}
+	}
+
+	// The first gene rises and the second falls over the samples
+	if math.Abs(cor.At(0, 1)+1) > 1e-12 {
+		t.Errorf("cor[0][1] = %v, want -1", cor.At(0, 1))
+	}
+}
+
+func TestDifferentialAdjacency(t *testing.T) {
+	corC1 := mat.NewSymDense(2, []float64{1, 0.8, 0.8, 1})
+	corC2 := mat.NewSymDense(2, []float64{1, -0.6, -0.6, 1})
+
+	adjC1 := adjacencyMatrix(corC1)
+	adjC2 := adjacencyMatrix(corC2)
+	if adjC1.At(0, 0) != 0 || adjC2.At(1, 1) != 0 {
+		t.Fatalf("adjacency diagonal should be zero")
+	}
+	if math.Abs(adjC2.At(0, 1)+0.36) > 1e-12 {
+		t.Fatalf("adjC2[0][1] = %v, want -0.36", adjC2.At(0, 1))
+	}
+
+	diff := differentialAdjacency(adjC1, adjC2, defaultBeta)
+	want := math.Pow((0.64+0.36)/2, 3)
+	if math.Abs(diff.At(0, 1)-want) > 1e-12 {
+		t.Errorf("diff[0][1] = %v, want %v", diff.At(0, 1), want)
+	}
+}
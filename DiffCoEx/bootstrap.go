@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// bootstrapOptions are the user defined parameters of the dispersion bootstrap
+type bootstrapOptions struct {
+	Samples int
+	Seed    int64
+	// Level is the coverage of the confidence intervals, e.g. 0.95
+	Level float64
+	// Threads is the number of goroutines (0 = all CPUs)
+	Threads int
+	// Progress receives progress reports (nil = no reporting)
+	Progress io.Writer
+}
+
+// dispersionInterval holds the bootstrap confidence intervals of one module to module dispersion
+type dispersionInterval struct {
+	// Bias is the mean of the bootstrap dispersions minus the observed one, StdError their standard deviation
+	Bias     float64
+	StdError float64
+	// PercentileLower and PercentileUpper are the quantiles of the bootstrap dispersions
+	PercentileLower float64
+	PercentileUpper float64
+	// BCaLower and BCaUpper are the bias corrected and accelerated interval, from the bias correction z0
+	// and the jackknife acceleration (NaN when every bootstrap dispersion is on one side of the observed one)
+	BCaLower       float64
+	BCaUpper       float64
+	BiasCorrection float64
+	Acceleration   float64
+}
+
+// bootstrapResult holds the observed module to module dispersions and their bootstrap distributions
+type bootstrapResult struct {
+	// Seed is the seed the bootstrap samples were drawn from
+	Seed int64
+	// Requested is the number of bootstrap samples asked for and Completed the number that finished,
+	// which is lower if the run was interrupted
+	Requested   int
+	Completed   int
+	Interrupted bool
+	Level       float64
+	Modules     []string
+	Dispersion  [][]float64
+	// Replicates[i][j] holds the dispersion of modules i and j on every completed bootstrap sample
+	Replicates [][][]float64
+	Intervals  [][]dispersionInterval
+}
+
+// resampleRows draws as many rows of d as it has, with replacement
+func resampleRows(d *mat.Dense, rng *rand.Rand) *mat.Dense {
+	rows, cols := d.Dims()
+	sample := mat.NewDense(rows, cols, nil)
+	for i := 0; i < rows; i++ {
+		sample.SetRow(i, d.RawRowView(rng.Intn(rows)))
+	}
+	return sample
+}
+
+// jackknifeAcceleration estimates the acceleration of the BCa interval from the jackknife dispersions of
+// each condition, leaving out one sample at a time. With a separate resampling in each condition, the
+// influence of sample i of condition g is (n_g - 1)(mean_g - theta_(i)) and the acceleration is
+// sum(L^3) / (6 sum(L^2)^1.5) over the samples of both conditions (Efron and Tibshirani 1993, ch. 14).
+// jackknife[g][i] is the dispersion matrix without sample i of condition g.
+func jackknifeAcceleration(jackknife [][][][]float64, a, b int) float64 {
+	var sum2, sum3 float64
+	for _, condition := range jackknife {
+		n := float64(len(condition))
+		if n < 2 {
+			continue
+		}
+		var mean float64
+		for _, d := range condition {
+			mean += d[a][b]
+		}
+		mean /= n
+		for _, d := range condition {
+			l := (n - 1) * (mean - d[a][b])
+			sum2 += l * l
+			sum3 += l * l * l
+		}
+	}
+	if sum2 == 0 {
+		return 0
+	}
+	return sum3 / (6 * math.Pow(sum2, 1.5))
+}
+
+// bootstrapInterval computes the percentile and BCa intervals (Efron 1987) of an observed statistic from its
+// bootstrap replicates and the acceleration
+func bootstrapInterval(observed float64, replicates []float64, acceleration, level float64) dispersionInterval {
+	interval := dispersionInterval{
+		PercentileLower: math.NaN(),
+		PercentileUpper: math.NaN(),
+		BCaLower:        math.NaN(),
+		BCaUpper:        math.NaN(),
+		BiasCorrection:  math.NaN(),
+		Acceleration:    acceleration,
+	}
+	if len(replicates) == 0 {
+		interval.Bias, interval.StdError = math.NaN(), math.NaN()
+		return interval
+	}
+	sorted := append([]float64{}, replicates...)
+	sort.Float64s(sorted)
+
+	mean, sd := stat.MeanStdDev(sorted, nil)
+	interval.Bias = mean - observed
+	interval.StdError = sd
+
+	alpha := (1 - level) / 2
+	interval.PercentileLower = stat.Quantile(alpha, stat.Empirical, sorted, nil)
+	interval.PercentileUpper = stat.Quantile(1-alpha, stat.Empirical, sorted, nil)
+
+	// z0 from the share of replicates below the observed value, counting ties as one half
+	below := 0.0
+	for _, v := range sorted {
+		if v < observed {
+			below++
+		} else if v == observed {
+			below += 0.5
+		}
+	}
+	share := below / float64(len(sorted))
+	if share == 0 || share == 1 {
+		return interval
+	}
+	z0 := distuv.UnitNormal.Quantile(share)
+	interval.BiasCorrection = z0
+
+	bound := func(p float64) float64 {
+		z := z0 + distuv.UnitNormal.Quantile(p)
+		denominator := 1 - acceleration*z
+		if denominator <= 0 {
+			return math.NaN()
+		}
+		return stat.Quantile(distuv.UnitNormal.CDF(z0+z/denominator), stat.Empirical, sorted, nil)
+	}
+	interval.BCaLower = bound(alpha)
+	interval.BCaUpper = bound(1 - alpha)
+	return interval
+}
+
+// moduleBootstrap computes the dispersion of every pair of modules between the two conditions and its
+// bootstrap distribution, resampling the samples of each condition with replacement. Bootstrap sample k
+// uses its own random stream, so the result only depends on the seed. If ctx is cancelled the intervals
+// are computed from the samples finished so far (without gaps), which are returned together with ctx.Err().
+func moduleBootstrap(ctx context.Context, datC1, datC2 *labelledMatrix, colorh1C1C2 map[string]string, modules []string, opts bootstrapOptions) (*bootstrapResult, error) {
+	subC1, members := moduleSubmatrix(datC1, colorh1C1C2, modules)
+	subC2, _ := moduleSubmatrix(datC2, colorh1C1C2, modules)
+	corC1, corC2 := spearmanMatrix(subC1), spearmanMatrix(subC2)
+
+	n := len(modules)
+	result := &bootstrapResult{
+		Seed:       opts.Seed,
+		Requested:  opts.Samples,
+		Level:      opts.Level,
+		Modules:    modules,
+		Dispersion: moduleDispersions(corC1, corC2, members),
+		Replicates: make([][][]float64, n),
+		Intervals:  make([][]dispersionInterval, n),
+	}
+	for i := range modules {
+		result.Replicates[i] = make([][]float64, n)
+		result.Intervals[i] = make([]dispersionInterval, n)
+	}
+
+	progress := newProgressReporter(opts.Progress, "Bootstrap samples", opts.Samples)
+	replicates := make([][][]float64, opts.Samples)
+	work := func(ctx context.Context, k int) bool {
+		rng := permutationRand(opts.Seed, k)
+		sampleC1 := resampleRows(subC1, rng)
+		sampleC2 := resampleRows(subC2, rng)
+		replicates[k] = moduleDispersions(spearmanMatrix(sampleC1), spearmanMatrix(sampleC2), members)
+		return true
+	}
+	finished, err := runPermutations(ctx, opts.Samples, opts.Threads, work, progress)
+	progress.finish()
+
+	for k := 0; k < opts.Samples && finished[k]; k++ {
+		for i := range modules {
+			for j := i; j < n; j++ {
+				result.Replicates[i][j] = append(result.Replicates[i][j], replicates[k][i][j])
+			}
+		}
+		result.Completed++
+	}
+
+	// Jackknife dispersions, leaving out one sample of one condition at a time
+	jackknife := make([][][][]float64, 2)
+	rows1, _ := subC1.Dims()
+	for i := 0; i < rows1; i++ {
+		jackknife[0] = append(jackknife[0], moduleDispersions(spearmanMatrix(removeRow(subC1, i)), corC2, members))
+	}
+	rows2, _ := subC2.Dims()
+	for i := 0; i < rows2; i++ {
+		jackknife[1] = append(jackknife[1], moduleDispersions(corC1, spearmanMatrix(removeRow(subC2, i)), members))
+	}
+
+	for i := range modules {
+		for j := i; j < n; j++ {
+			acceleration := jackknifeAcceleration(jackknife, i, j)
+			result.Intervals[i][j] = bootstrapInterval(result.Dispersion[i][j], result.Replicates[i][j], acceleration, opts.Level)
+			result.Intervals[j][i] = result.Intervals[i][j]
+			result.Replicates[j][i] = result.Replicates[i][j]
+		}
+	}
+	result.Interrupted = err != nil
+	return result, err
+}
+
+// seedComment describes how the bootstrap samples were drawn, so a run can be repeated
+func (r *bootstrapResult) seedComment() string {
+	comment := fmt.Sprintf("seed %d, %d bootstrap samples, %g%% intervals", r.Seed, r.Requested, 100*r.Level)
+	if r.Interrupted {
+		comment += fmt.Sprintf(", interrupted after %d", r.Completed)
+	}
+	return comment
+}
+
+// saveDispersionIntervals writes one row per pair of modules (each unordered pair once) with the observed
+// dispersion, the bootstrap bias and standard error, the percentile and BCa intervals and the BCa constants
+func saveDispersionIntervals(r *bootstrapResult, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "# %s\n", r.seedComment()); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"module1", "module2", "dispersion", "bias", "se", "samples",
+		"perc.lower", "perc.upper", "bca.lower", "bca.upper", "bca.z0", "bca.acceleration"}); err != nil {
+		return err
+	}
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			interval := r.Intervals[i][j]
+			row := []string{
+				r.Modules[i], r.Modules[j],
+				strconv.FormatFloat(r.Dispersion[i][j], 'g', -1, 64),
+				formatNA(interval.Bias),
+				formatNA(interval.StdError),
+				strconv.Itoa(len(r.Replicates[i][j])),
+				formatNA(interval.PercentileLower),
+				formatNA(interval.PercentileUpper),
+				formatNA(interval.BCaLower),
+				formatNA(interval.BCaUpper),
+				formatNA(interval.BiasCorrection),
+				formatNA(interval.Acceleration),
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveBootstrapReplicates writes one CSV row per pair of modules (each unordered pair once) followed by
+// its dispersion on every bootstrap sample. Pairs share the samples, so two dispersions can be compared
+// sample by sample.
+func saveBootstrapReplicates(r *bootstrapResult, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "# %s\n", r.seedComment()); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	header := []string{"module1", "module2"}
+	for k := 0; k < r.Completed; k++ {
+		header = append(header, fmt.Sprintf("boot%d", k+1))
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			row := []string{r.Modules[i], r.Modules[j]}
+			for _, v := range r.Replicates[i][j] {
+				row = append(row, strconv.FormatFloat(v, 'g', -1, 64))
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runBootstrap computes bootstrap confidence intervals of the module to module dispersions of two condition
+// files and a module file, leaving out the grey (unassigned) genes
+func runBootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	modulesFile := fs.String("modules", "", "gene module file (\"gene color\" per line)")
+	samples := fs.Int("b", 1000, "number of bootstrap samples")
+	seed := fs.Int64("seed", seedFromClock, "random seed for the bootstrap samples (negative = seed from the clock)")
+	level := fs.Float64("level", 0.95, "coverage of the confidence intervals")
+	threads := fs.Int("threads", 0, "goroutines used for the bootstrap (0 = all CPUs)")
+	out := fs.String("out", "dispersion_intervals.csv", "output confidence interval of every pair of modules")
+	replicatesOut := fs.String("replicates", "", "optional output of the bootstrap dispersions of every pair of modules")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" || *modulesFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-c1, -c2 and -modules are required")
+	}
+	if *samples < 1 {
+		return fmt.Errorf("-b must be at least 1")
+	}
+	if !(*level > 0 && *level < 1) {
+		return fmt.Errorf("-level must be between 0 and 1")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	colorh1C1C2, err := genecolor.ReadFile(*modulesFile)
+	if err != nil {
+		return err
+	}
+
+	missing, unassigned := moduleMembership(dataC1.GeneIDs, colorh1C1C2)
+	reportGenes(fmt.Sprintf("genes in %s missing from the expression data", *modulesFile), missing)
+	reportGenes(fmt.Sprintf("genes in the expression data without a module (treated as %s)", greyLabel), unassigned)
+
+	modules, _ := moduleColumns(colorsForGenes(dataC1.GeneIDs, colorh1C1C2))
+	if len(modules) == 0 {
+		return fmt.Errorf("no modules besides %s match the genes of the expression data", greyLabel)
+	}
+	*seed = resolveSeed(*seed)
+
+	datC1 := &labelledMatrix{Data: samplesByGenes(dataC1.Data), GeneIDs: dataC1.GeneIDs}
+	datC2 := &labelledMatrix{Data: samplesByGenes(dataC2.Data), GeneIDs: dataC2.GeneIDs}
+
+	// Ctrl-C stops the bootstrap; the intervals use the samples finished so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Drawing %d bootstrap samples for %d modules (seed %d)...\n", *samples, len(modules), *seed)
+	opts := bootstrapOptions{Samples: *samples, Seed: *seed, Level: *level, Threads: *threads, Progress: os.Stderr}
+	result, runErr := moduleBootstrap(ctx, datC1, datC2, colorh1C1C2, modules, opts)
+	stop()
+
+	saved := *out
+	if err := saveDispersionIntervals(result, *out); err != nil {
+		return err
+	}
+	if *replicatesOut != "" {
+		if err := saveBootstrapReplicates(result, *replicatesOut); err != nil {
+			return err
+		}
+		saved += ", " + *replicatesOut
+	}
+
+	if runErr != nil {
+		return fmt.Errorf("interrupted after %d of %d bootstrap samples, partial results saved to %s",
+			result.Completed, result.Requested, saved)
+	}
+	fmt.Printf("Files saved: %s\n", saved)
+	return nil
+}
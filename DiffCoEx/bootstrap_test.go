@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestBootstrapIntervalWithoutBias(t *testing.T) {
+	// Replicates symmetric around the observed value: z0 = 0, so with no acceleration the BCa interval
+	// is the percentile interval
+	var replicates []float64
+	for k := -50; k <= 50; k++ {
+		replicates = append(replicates, 1+float64(k)/100)
+	}
+	interval := bootstrapInterval(1, replicates, 0, 0.9)
+	if interval.BiasCorrection != 0 || math.Abs(interval.Bias) > 1e-12 {
+		t.Errorf("z0 = %v, bias = %v, want 0", interval.BiasCorrection, interval.Bias)
+	}
+	if interval.PercentileLower != 0.55 || interval.PercentileUpper != 1.45 {
+		t.Errorf("percentile interval = [%v, %v], want [0.55, 1.45]", interval.PercentileLower, interval.PercentileUpper)
+	}
+	if interval.BCaLower != interval.PercentileLower || interval.BCaUpper != interval.PercentileUpper {
+		t.Errorf("BCa interval = [%v, %v], want the percentile interval", interval.BCaLower, interval.BCaUpper)
+	}
+
+	// A positive acceleration moves both ends up
+	accelerated := bootstrapInterval(1, replicates, 0.1, 0.9)
+	if !(accelerated.BCaLower > interval.BCaLower && accelerated.BCaUpper > interval.BCaUpper) {
+		t.Errorf("accelerated BCa interval = [%v, %v], want it above [%v, %v]",
+			accelerated.BCaLower, accelerated.BCaUpper, interval.BCaLower, interval.BCaUpper)
+	}
+
+	// Every replicate above the observed value leaves z0 undefined
+	shifted := bootstrapInterval(0, replicates, 0, 0.9)
+	if !math.IsNaN(shifted.BCaLower) || !math.IsNaN(shifted.BCaUpper) {
+		t.Errorf("BCa interval = [%v, %v], want NaN", shifted.BCaLower, shifted.BCaUpper)
+	}
+}
+
+func TestJackknifeAcceleration(t *testing.T) {
+	// One condition with jackknife values 1, 1, 4 for the pair (0, 0): mean 2, L = 2, 2, -4
+	jackknife := [][][][]float64{
+		{{{1}}, {{1}}, {{4}}},
+		{{{3}}, {{3}}},
+	}
+	want := (8 + 8 - 64) / (6 * math.Pow(24, 1.5))
+	if got := jackknifeAcceleration(jackknife, 0, 0); math.Abs(got-want) > 1e-12 {
+		t.Errorf("acceleration = %v, want %v", got, want)
+	}
+}
+
+func TestModuleBootstrapIndependentOfThreads(t *testing.T) {
+	datC1, datC2, colorh1C1C2 := randomConditions(3)
+	modules := []string{"blue", "red"}
+	one, err := moduleBootstrap(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		bootstrapOptions{Samples: 60, Seed: 4, Level: 0.95, Threads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	many, err := moduleBootstrap(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		bootstrapOptions{Samples: 60, Seed: 4, Level: 0.95, Threads: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range modules {
+		for j := range modules {
+			if len(one.Replicates[i][j]) != 60 {
+				t.Fatalf("pair %d-%d has %d bootstrap dispersions, want 60", i, j, len(one.Replicates[i][j]))
+			}
+			for k := range one.Replicates[i][j] {
+				if one.Replicates[i][j][k] != many.Replicates[i][j][k] {
+					t.Fatalf("Replicates[%d][%d][%d] = %v with 1 thread, %v with 16", i, j, k, one.Replicates[i][j][k], many.Replicates[i][j][k])
+				}
+			}
+			interval := one.Intervals[i][j]
+			if !(interval.PercentileLower <= interval.PercentileUpper) {
+				t.Errorf("pair %d-%d percentile interval = [%v, %v]", i, j, interval.PercentileLower, interval.PercentileUpper)
+			}
+			if one.Intervals[i][j] != one.Intervals[j][i] {
+				t.Errorf("intervals of %d-%d and %d-%d differ", i, j, j, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// standardColors is WGCNA's standardColors(), the order in which labels2colors hands out module colors:
+// the 34 classic module colors followed by the 401 other R colors() whose names contain neither grey,
+// gray nor black. WGCNA orders that second part as colorsNoBase[rank(sin(13 * k + sin(13 * k)))] for k = 1..401, so
+// that neighbouring labels get unrelated colors. Grey is not in the list because it is reserved for
+// unassigned genes; past the 435 colors the list repeats with a suffix, see labelColor.
+var standardColors = []string{
+	"turquoise", "blue", "brown", "yellow", "green", "red", "black", "pink", "magenta", "purple",
+	"greenyellow", "tan", "salmon", "cyan", "midnightblue", "lightcyan", "grey60", "lightgreen",
+	"lightyellow", "royalblue", "darkred", "darkgreen", "darkturquoise", "darkgrey", "orange",
+	"darkorange", "white", "skyblue", "saddlebrown", "steelblue", "paleturquoise", "violet",
+	"darkolivegreen", "darkmagenta",
+	"sienna3", "yellowgreen", "skyblue3", "plum1", "orangered4", "mediumpurple3", "lightsteelblue1",
+	"lightcyan1", "ivory", "floralwhite", "darkorange2", "brown4", "bisque4", "darkslateblue",
+	"plum2", "thistle2", "thistle1", "salmon4", "palevioletred3", "navajowhite2", "maroon",
+	"lightpink4", "lavenderblush3", "honeydew1", "darkseagreen4", "coral1", "antiquewhite4", "coral2",
+	"mediumorchid", "skyblue2", "yellow4", "skyblue1", "plum", "orangered3", "mediumpurple2",
+	"lightsteelblue", "lightcoral", "indianred4", "firebrick4", "darkolivegreen4", "brown2", "blue2",
+	"darkviolet", "plum3", "thistle3", "thistle", "salmon2", "palevioletred2", "navajowhite1",
+	"magenta4", "lightpink3", "lavenderblush2", "honeydew", "darkseagreen3", "coral", "antiquewhite2",
+	"coral3", "mediumpurple4", "skyblue4", "yellow3", "sienna4", "pink4", "orangered1",
+	"mediumpurple1", "lightslateblue", "lightblue4", "indianred3", "firebrick3", "darkolivegreen2",
+	"blueviolet", "blue4", "deeppink", "plum4", "thistle4", "tan4", "salmon1", "palevioletred1",
+	"navajowhite", "magenta3", "lightpink2", "lavenderblush1", "green4", "darkseagreen2",
+	"chocolate4", "antiquewhite1", "coral4", "mistyrose", "slateblue", "yellow2", "sienna2", "pink3",
+	"orangered", "mediumpurple", "lightskyblue4", "lightblue3", "indianred2", "firebrick2",
+	"darkolivegreen1", "blue3", "brown1", "deeppink1", "powderblue", "tomato", "tan3", "royalblue3",
+	"palevioletred", "moccasin", "magenta2", "lightpink1", "lavenderblush", "green3", "darkseagreen1",
+	"chocolate3", "aliceblue", "cornflowerblue", "navajowhite3", "slateblue1", "whitesmoke",
+	"sienna1", "pink2", "orange4", "mediumorchid4", "lightskyblue3", "lightblue2", "indianred1",
+	"firebrick", "darkgoldenrod4", "blue1", "brown3", "deeppink2", "purple2", "tomato2", "tan2",
+	"royalblue2", "paleturquoise4", "mistyrose4", "magenta1", "lightpink", "lavender", "green2",
+	"darkseagreen", "chocolate2", "antiquewhite", "cornsilk", "navajowhite4", "slateblue2", "wheat3",
+	"sienna", "pink1", "orange3", "mediumorchid3", "lightskyblue2", "lightblue1", "indianred",
+	"dodgerblue4", "darkgoldenrod3", "blanchedalmond", "burlywood", "deepskyblue", "red1", "tomato4",
+	"tan1", "rosybrown4", "paleturquoise3", "mistyrose3", "linen", "lightgoldenrodyellow", "khaki4",
+	"green1", "darksalmon", "chocolate1", "antiquewhite3", "cornsilk2", "oldlace", "slateblue3",
+	"wheat1", "seashell4", "peru", "orange2", "mediumorchid2", "lightskyblue1", "lightblue",
+	"hotpink4", "dodgerblue3", "darkgoldenrod1", "bisque3", "burlywood1", "deepskyblue4", "red4",
+	"turquoise2", "steelblue4", "rosybrown3", "paleturquoise1", "mistyrose2", "limegreen",
+	"lightgoldenrod4", "khaki3", "goldenrod4", "darkorchid4", "chocolate", "aquamarine", "cyan1",
+	"orange1", "slateblue4", "violetred4", "seashell3", "peachpuff4", "olivedrab4", "mediumorchid1",
+	"lightskyblue", "lemonchiffon4", "hotpink3", "dodgerblue1", "darkgoldenrod", "bisque2",
+	"burlywood2", "dodgerblue2", "rosybrown2", "turquoise4", "steelblue3", "rosybrown1", "palegreen4",
+	"mistyrose1", "lightyellow4", "lightgoldenrod3", "khaki2", "goldenrod3", "darkorchid3",
+	"chartreuse4", "aquamarine1", "cyan4", "orangered2", "snow", "violetred2", "seashell2",
+	"peachpuff3", "olivedrab3", "mediumblue", "lightseagreen", "lemonchiffon3", "hotpink2",
+	"dodgerblue", "darkblue", "bisque1", "burlywood3", "firebrick1", "royalblue1", "violetred1",
+	"steelblue1", "rosybrown", "palegreen3", "mintcream", "lightyellow3", "lightgoldenrod2", "khaki1",
+	"goldenrod2", "darkorchid2", "chartreuse3", "aquamarine2", "darkcyan", "orchid", "snow2",
+	"violetred", "seashell1", "peachpuff2", "olivedrab2", "mediumaquamarine", "lightsalmon4",
+	"lemonchiffon2", "hotpink1", "deepskyblue3", "cyan3", "bisque", "burlywood4", "forestgreen",
+	"royalblue4", "violetred3", "springgreen3", "red3", "palegreen1", "mediumvioletred",
+	"lightyellow2", "lightgoldenrod1", "khaki", "goldenrod1", "darkorchid1", "chartreuse2",
+	"aquamarine3", "darkgoldenrod2", "orchid1", "snow4", "turquoise3", "seashell", "peachpuff1",
+	"olivedrab1", "maroon4", "lightsalmon3", "lemonchiffon1", "hotpink", "deepskyblue2", "cyan2",
+	"beige", "cadetblue", "gainsboro", "salmon3", "wheat", "springgreen2", "red2", "palegreen",
+	"mediumturquoise", "lightyellow1", "lightgoldenrod", "ivory4", "goldenrod", "darkorchid",
+	"chartreuse1", "aquamarine4", "darkkhaki", "orchid3", "springgreen1", "turquoise1", "seagreen4",
+	"peachpuff", "olivedrab", "maroon3", "lightsalmon2", "lemonchiffon", "honeydew4", "deepskyblue1",
+	"cornsilk4", "azure4", "cadetblue1", "ghostwhite", "sandybrown", "wheat2", "springgreen",
+	"purple4", "palegoldenrod", "mediumspringgreen", "lightsteelblue4", "lightcyan4", "ivory3",
+	"gold3", "darkorange4", "chartreuse", "azure", "darkolivegreen3", "palegreen2", "springgreen4",
+	"tomato3", "seagreen3", "papayawhip", "navyblue", "maroon2", "lightsalmon1", "lawngreen",
+	"honeydew3", "deeppink4", "cornsilk3", "azure3", "cadetblue2", "gold", "seagreen", "wheat4",
+	"snow3", "purple3", "orchid4", "mediumslateblue", "lightsteelblue3", "lightcyan3", "ivory2",
+	"gold2", "darkorange3", "cadetblue4", "azure1", "darkorange1", "paleturquoise2", "steelblue2",
+	"tomato1", "seagreen2", "palevioletred4", "navy", "maroon1", "lightsalmon", "lavenderblush4",
+	"honeydew2", "deeppink3", "cornsilk1", "azure2", "cadetblue3", "gold4", "seagreen1", "yellow1",
+	"snow1", "purple1", "orchid2", "mediumseagreen", "lightsteelblue2", "lightcyan2", "ivory1",
+	"gold1",
+}
+
+// labelColor returns the color for position i (0-based) of the color sequence. Once the standard colors
+// run out the whole list is reused with a numeric suffix starting at 2 ("turquoise.2", "blue.2", ...),
+// as labels2colors does with paste(colorSeq, ".", 2:nRepeats).
+func labelColor(i int) string {
+	n := len(standardColors)
+	if i < n {
+		return standardColors[i]
+	}
+	return fmt.Sprintf("%s.%d", standardColors[i%n], i/n+1)
+}
+
+// labels2colors converts numeric module labels into WGCNA color names: label 0 is grey and label k gets
+// the k-th standard color. WGCNA's zeroIsGrey argument only matters for non-numeric labels, so numeric
+// labels map the same way with either setting, and coXpress cutree groups (which start at 1) begin at
+// turquoise. Negative labels are grey.
+func labels2colors(labels []int) []string {
+	colors := make([]string, len(labels))
+	for i, label := range labels {
+		if label <= 0 {
+			colors[i] = greyLabel
+		} else {
+			colors[i] = labelColor(label - 1)
+		}
+	}
+	return colors
+}
+
+// colors2labels is the inverse of labels2colors
+func colors2labels(colors []string) ([]int, error) {
+	index := make(map[string]int, len(standardColors))
+	for i, color := range standardColors {
+		index[color] = i
+	}
+
+	labels := make([]int, len(colors))
+	for i, color := range colors {
+		if color == greyLabel {
+			labels[i] = 0
+			continue
+		}
+
+		name, repeat := color, 0
+		if dot := strings.LastIndex(color, "."); dot >= 0 {
+			r, err := strconv.Atoi(color[dot+1:])
+			if err != nil || r < 2 {
+				return nil, fmt.Errorf("unknown module color %q", color)
+			}
+			name, repeat = color[:dot], r
+		}
+		pos, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown module color %q", color)
+		}
+
+		label := pos + 1
+		if repeat > 0 {
+			label += (repeat - 1) * len(standardColors)
+		}
+		labels[i] = label
+	}
+	return labels, nil
+}
+
+// numericLabels parses module labels that are cluster numbers, such as the coXpress cutree groups
+func numericLabels(labels []string) ([]int, error) {
+	numbers := make([]int, len(labels))
+	for i, label := range labels {
+		n, err := strconv.Atoi(label)
+		if err != nil {
+			return nil, fmt.Errorf("label %q is not a cluster number", label)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
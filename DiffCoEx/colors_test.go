@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestLabels2Colors(t *testing.T) {
+	n := len(standardColors)
+	if n != 435 {
+		t.Fatalf("%d standard colors, want WGCNA's 435", n)
+	}
+
+	colors := labels2colors([]int{0, 1, 2, 15, 34, 35, 106, n, n + 1, n + 2, -1})
+	want := []string{"grey", "turquoise", "blue", "midnightblue", "darkmagenta", "sienna3", "deeppink", "gold1",
+		"turquoise.2", "blue.2", "grey"}
+	for i := range want {
+		if colors[i] != want[i] {
+			t.Fatalf("labels2colors() = %v, want %v", colors, want)
+		}
+	}
+
+	seen := make(map[string]bool, n)
+	for _, color := range standardColors {
+		if seen[color] || color == greyLabel {
+			t.Fatalf("%q is repeated or grey", color)
+		}
+		seen[color] = true
+	}
+}
+
+func TestColors2LabelsRoundTrip(t *testing.T) {
+	n := len(standardColors)
+	labels := []int{0, 3, 1, 40, 17, 0, 69, n, n + 1, 2*n + 5}
+	back, err := colors2labels(labels2colors(labels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range labels {
+		if back[i] != labels[i] {
+			t.Fatalf("round trip gave %v, want %v", back, labels)
+		}
+	}
+
+	if _, err := colors2labels([]string{"notacolor"}); err == nil {
+		t.Errorf("expected an error for an unknown color")
+	}
+	// Repeats start at .2, so .1 is not a color labels2colors produces
+	if _, err := colors2labels([]string{"turquoise.1"}); err == nil {
+		t.Errorf("expected an error for turquoise.1")
+	}
+}
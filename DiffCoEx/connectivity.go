@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"github.com/kcw27/PFS_Group_Project/multipletesting"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// connectivityBatch is the number of permutations kept in memory before their differences are counted;
+// batches are counted in order so that an interrupted run only depends on the seed
+const connectivityBatch = 50
+
+// geneConnectivity holds the connectivity of one gene in each condition and its permutation tests
+type geneConnectivity struct {
+	Gene   string
+	Module string
+	// KWithin1 and KWithin2 are the intramodular connectivities (NaN for grey genes), KTotal1 and KTotal2
+	// the connectivities over the whole network
+	KWithin1 float64
+	KWithin2 float64
+	KTotal1  float64
+	KTotal2  float64
+	// ScaledKDiff and ScaledKTotalDiff are the differences of the connectivities divided by the largest
+	// connectivity of the module (or network) in each condition
+	ScaledKDiff      float64
+	ScaledKTotalDiff float64
+	// Exceedances count the permutations with an absolute scaled difference equal to or higher than the
+	// observed one, out of Permutations
+	ExceedancesWithin int
+	ExceedancesTotal  int
+	Permutations      int
+	PWithin           float64
+	PTotal            float64
+	// PWithinAdjusted and PTotalAdjusted are corrected for multiple testing over the genes
+	PWithinAdjusted float64
+	PTotalAdjusted  float64
+}
+
+// KDiff is the difference of the intramodular connectivities, condition 1 minus condition 2
+func (g *geneConnectivity) KDiff() float64 {
+	return g.KWithin1 - g.KWithin2
+}
+
+// KTotalDiff is the difference of the whole network connectivities, condition 1 minus condition 2
+func (g *geneConnectivity) KTotalDiff() float64 {
+	return g.KTotal1 - g.KTotal2
+}
+
+// connectivity returns the intramodular connectivity (the sum of the adjacencies to the other genes of
+// its module, NaN for genes outside every module) and the whole network connectivity of every gene, with
+// the unsigned adjacency |cor|^beta. members[m] holds the genes of module m. It needs the full correlation
+// matrix, so only moduleMemberships (hubs.go) uses it, on the module genes; the connectivity test sums the
+// same values from the ranked genes with rankedConnectivity.
+func connectivity(cor mat.Symmetric, members [][]int, beta float64) ([]float64, []float64) {
+	n := cor.SymmetricDim()
+	within := make([]float64, n)
+	total := make([]float64, n)
+	for i := range within {
+		within[i] = math.NaN()
+	}
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			a := math.Pow(math.Abs(cor.At(i, j)), beta)
+			total[i] += a
+			total[j] += a
+		}
+	}
+	for _, genes := range members {
+		for _, i := range genes {
+			within[i] = 0
+			for _, j := range genes {
+				if i != j {
+					within[i] += math.Pow(math.Abs(cor.At(i, j)), beta)
+				}
+			}
+		}
+	}
+	return within, total
+}
+
+// scaledDifference returns k1/max(k1) - k2/max(k2) for every gene, the maxima being taken over the given
+// groups of genes (Fuller et al. 2007), so that the connectivities of both conditions are on the same scale
+func scaledDifference(k1, k2 []float64, groups [][]int) []float64 {
+	diff := make([]float64, len(k1))
+	for i := range diff {
+		diff[i] = math.NaN()
+	}
+	for _, genes := range groups {
+		var max1, max2 float64
+		for _, i := range genes {
+			max1 = math.Max(max1, k1[i])
+			max2 = math.Max(max2, k2[i])
+		}
+		for _, i := range genes {
+			var s1, s2 float64
+			if max1 > 0 {
+				s1 = k1[i] / max1
+			}
+			if max2 > 0 {
+				s2 = k2[i] / max2
+			}
+			diff[i] = s1 - s2
+		}
+	}
+	return diff
+}
+
+// rankedColumns returns every gene (column of data, samples x genes) as its ranks centred and scaled to
+// unit length, so that the Spearman correlation of two genes is the dot product of their vectors, as in
+// spearmanMatrix. Genes with zero variance become zero vectors (a correlation of 0).
+func rankedColumns(data *mat.Dense) [][]float64 {
+	_, cols := data.Dims()
+	columns := make([][]float64, cols)
+	for j := range columns {
+		column := rankVector(getColumn(data, j))
+		mean := meanFloat(column)
+		var norm float64
+		for i := range column {
+			column[i] -= mean
+			norm += column[i] * column[i]
+		}
+		norm = math.Sqrt(norm)
+		for i := range column {
+			if norm != 0 {
+				column[i] /= norm
+			} else {
+				column[i] = 0
+			}
+		}
+		columns[j] = column
+	}
+	return columns
+}
+
+// rankedConnectivity returns what connectivity returns for the Spearman correlations of the ranked
+// columns, taking every correlation as a dot product when it is needed. It never holds the gene by gene
+// matrix, so its memory grows with genes x samples rather than genes^2.
+func rankedConnectivity(columns [][]float64, members [][]int, beta float64) ([]float64, []float64) {
+	n := len(columns)
+	module := make([]int, n)
+	within := make([]float64, n)
+	total := make([]float64, n)
+	for i := range module {
+		module[i] = -1
+		within[i] = math.NaN()
+	}
+	for m, genes := range members {
+		for _, i := range genes {
+			module[i] = m
+			within[i] = 0
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			a := math.Pow(math.Abs(floats.Dot(columns[i], columns[j])), beta)
+			total[i] += a
+			total[j] += a
+			if module[i] >= 0 && module[i] == module[j] {
+				within[i] += a
+				within[j] += a
+			}
+		}
+	}
+	return within, total
+}
+
+// connectivityDifferences returns the scaled differences of the intramodular and of the whole network
+// connectivities of the two conditions
+func connectivityDifferences(within1, total1, within2, total2 []float64, members [][]int) ([]float64, []float64) {
+	all := make([]int, len(total1))
+	for i := range all {
+		all[i] = i
+	}
+	return scaledDifference(within1, within2, members), scaledDifference(total1, total2, [][]int{all})
+}
+
+// permutedConnectivity returns the scaled connectivity differences of one permutation of the combined
+// samples d (see combineAndScaleData)
+func permutedConnectivity(d *mat.Dense, permutation []int, members [][]int, beta float64) ([]float64, []float64) {
+	d1, d2 := splitRows(d, permutation)
+	within1, total1 := rankedConnectivity(rankedColumns(d1), members, beta)
+	within2, total2 := rankedConnectivity(rankedColumns(d2), members, beta)
+	return connectivityDifferences(within1, total1, within2, total2, members)
+}
+
+// connectivityOptions are the user defined parameters of the gene connectivity test
+type connectivityOptions struct {
+	Beta         float64
+	Permutations int
+	Seed         int64
+	// Strata restricts the permutations to shuffle samples within strata (nil = shuffle all samples)
+	Strata *sampleStrata
+	// Threads is the number of goroutines (0 = all CPUs)
+	Threads int
+	// Progress receives progress reports (nil = no reporting)
+	Progress io.Writer
+}
+
+// geneConnectivityTest computes the connectivity of every gene in both conditions, within its module and
+// over the whole network, and tests the scaled differences with the permutations of the module test
+// (random splits of the combined samples, each condition scaled on its own, drawn from the same
+// per-permutation streams). Both tests are two sided. The connectivities are summed from the ranked
+// genes without building correlation matrices, so every goroutine needs memory for genes x samples only.
+// If ctx is cancelled the permutations finished so far (without gaps) are used and ctx.Err() is returned
+// with the scores.
+func geneConnectivityTest(ctx context.Context, datC1, datC2 *labelledMatrix, colorh1C1C2 map[string]string, opts connectivityOptions) ([]geneConnectivity, int, error) {
+	labels := colorsForGenes(datC1.GeneIDs, colorh1C1C2)
+	modules, columns := moduleColumns(labels)
+	members := make([][]int, len(modules))
+	for m, module := range modules {
+		members[m] = columns[module]
+	}
+
+	within1, total1 := rankedConnectivity(rankedColumns(datC1.Data), members, opts.Beta)
+	within2, total2 := rankedConnectivity(rankedColumns(datC2.Data), members, opts.Beta)
+	observedWithin, observedTotal := connectivityDifferences(within1, total1, within2, total2, members)
+
+	genes := make([]geneConnectivity, len(labels))
+	for i := range genes {
+		genes[i] = geneConnectivity{
+			Gene:             datC1.GeneIDs[i],
+			Module:           labels[i],
+			KWithin1:         within1[i],
+			KWithin2:         within2[i],
+			KTotal1:          total1[i],
+			KTotal2:          total2[i],
+			ScaledKDiff:      observedWithin[i],
+			ScaledKTotalDiff: observedTotal[i],
+		}
+	}
+
+	rows1, _ := datC1.Data.Dims()
+	rows2, _ := datC2.Data.Dims()
+	d := combineAndScaleData(datC1.Data, datC2.Data)
+
+	progress := newProgressReporter(opts.Progress, "Permutations", opts.Permutations)
+	defer progress.finish()
+
+	completed := 0
+	nullWithin := make([][]float64, connectivityBatch)
+	nullTotal := make([][]float64, connectivityBatch)
+	var err error
+	for start := 0; start < opts.Permutations && err == nil; start += connectivityBatch {
+		batch := connectivityBatch
+		if start+batch > opts.Permutations {
+			batch = opts.Permutations - start
+		}
+		work := func(ctx context.Context, k int) bool {
+			permutation := drawPermutation(opts.Seed, start+k, rows1, rows2, opts.Strata)
+			nullWithin[k], nullTotal[k] = permutedConnectivity(d, permutation, members, opts.Beta)
+			return true
+		}
+		var finished []bool
+		finished, err = runPermutations(ctx, batch, opts.Threads, work, progress)
+
+		for k := 0; k < batch && finished[k]; k++ {
+			for i := range genes {
+				if math.Abs(nullWithin[k][i]) >= math.Abs(observedWithin[i]) {
+					genes[i].ExceedancesWithin++
+				}
+				if math.Abs(nullTotal[k][i]) >= math.Abs(observedTotal[i]) {
+					genes[i].ExceedancesTotal++
+				}
+			}
+			completed++
+		}
+	}
+
+	for i := range genes {
+		genes[i].Permutations = completed
+		genes[i].PWithin = sequentialPValue(genes[i].ExceedancesWithin, completed, 0, false)
+		genes[i].PTotal = sequentialPValue(genes[i].ExceedancesTotal, completed, 0, false)
+		if math.IsNaN(observedWithin[i]) {
+			// Grey genes have no module to be connected within
+			genes[i].PWithin = math.NaN()
+		}
+	}
+	return genes, completed, err
+}
+
+// adjustConnectivity corrects the within module and the whole network p-values over the genes, as two
+// separate families
+func adjustConnectivity(genes []geneConnectivity, method string) error {
+	within := make([]float64, len(genes))
+	total := make([]float64, len(genes))
+	for i, g := range genes {
+		within[i] = g.PWithin
+		total[i] = g.PTotal
+	}
+	adjustedWithin, err := multipletesting.Adjust(within, method)
+	if err != nil {
+		return err
+	}
+	adjustedTotal, err := multipletesting.Adjust(total, method)
+	if err != nil {
+		return err
+	}
+	for i := range genes {
+		genes[i].PWithinAdjusted = adjustedWithin[i]
+		genes[i].PTotalAdjusted = adjustedTotal[i]
+	}
+	return nil
+}
+
+// rankConnectivity orders the genes by their within module p-value, then by the size of their scaled
+// difference; grey genes follow, ordered by their whole network p-value
+func rankConnectivity(genes []geneConnectivity) {
+	sort.SliceStable(genes, func(a, b int) bool {
+		ga, gb := genes[a], genes[b]
+		greyA, greyB := math.IsNaN(ga.PWithin), math.IsNaN(gb.PWithin)
+		if greyA != greyB {
+			return greyB
+		}
+		if greyA {
+			if ga.PTotal != gb.PTotal {
+				return ga.PTotal < gb.PTotal
+			}
+			return math.Abs(ga.ScaledKTotalDiff) > math.Abs(gb.ScaledKTotalDiff)
+		}
+		if ga.PWithin != gb.PWithin {
+			return ga.PWithin < gb.PWithin
+		}
+		return math.Abs(ga.ScaledKDiff) > math.Abs(gb.ScaledKDiff)
+	})
+}
+
+// saveGeneConnectivity writes the ranked genes with their connectivities, differences and p-values; the
+// adjusted p-value columns are named after the correction. The first line records how the run was made.
+func saveGeneConnectivity(genes []geneConnectivity, comment, method, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "# %s\n", comment); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"rank", "gene", "module",
+		"k.within.c1", "k.within.c2", "kDiff", "scaled.kDiff",
+		"k.total.c1", "k.total.c2", "kTotalDiff", "scaled.kTotalDiff",
+		"permutations", "p.within", "p.within." + method, "p.total", "p.total." + method}); err != nil {
+		return err
+	}
+	for r, g := range genes {
+		row := []string{
+			strconv.Itoa(r + 1), g.Gene, g.Module,
+			formatNA(g.KWithin1), formatNA(g.KWithin2), formatNA(g.KDiff()), formatNA(g.ScaledKDiff),
+			formatNA(g.KTotal1), formatNA(g.KTotal2), formatNA(g.KTotalDiff()), formatNA(g.ScaledKTotalDiff),
+			strconv.Itoa(g.Permutations),
+			formatNA(g.PWithin), formatNA(g.PWithinAdjusted), formatNA(g.PTotal), formatNA(g.PTotalAdjusted),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runConnectivity scores the differential connectivity of every gene of two condition files, within its
+// module of a module file and over the whole network, and writes a ranked table
+func runConnectivity(args []string) error {
+	fs := flag.NewFlagSet("connectivity", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	modulesFile := fs.String("modules", "", "gene module file (\"gene color\" per line)")
+	beta := fs.Float64("beta", defaultBeta, "soft thresholding power of the adjacency |cor|^beta")
+	numPermutations := fs.Int("n", 1000, "number of permutations")
+	seed := fs.Int64("seed", seedFromClock, "random seed for the permutations (negative = seed from the clock)")
+	metadataFile := fs.String("metadata", "", "sample metadata file with a header, one row per sample of c1 then c2, for -strata")
+	strataColumns := fs.String("strata", "", "comma separated metadata columns (e.g. agent,time); permutations only shuffle samples within their strata")
+	threads := fs.Int("threads", 0, "goroutines used for the permutations (0 = all CPUs)")
+	adjust := fs.String("adjust", "BH", "multiple testing correction of the gene p-values: "+strings.Join(multipletesting.Methods, ", "))
+	out := fs.String("out", "gene_connectivity.csv", "output ranked table of the genes")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" || *modulesFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-c1, -c2 and -modules are required")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	colorh1C1C2, err := genecolor.ReadFile(*modulesFile)
+	if err != nil {
+		return err
+	}
+
+	missing, unassigned := moduleMembership(dataC1.GeneIDs, colorh1C1C2)
+	reportGenes(fmt.Sprintf("genes in %s missing from the expression data", *modulesFile), missing)
+	reportGenes(fmt.Sprintf("genes in the expression data without a module (treated as %s)", greyLabel), unassigned)
+
+	if _, err := multipletesting.Adjust(nil, *adjust); err != nil {
+		return err
+	}
+	*seed = resolveSeed(*seed)
+
+	datC1 := &labelledMatrix{Data: samplesByGenes(dataC1.Data), GeneIDs: dataC1.GeneIDs}
+	datC2 := &labelledMatrix{Data: samplesByGenes(dataC2.Data), GeneIDs: dataC2.GeneIDs}
+	strata, err := strataFromFlags(*metadataFile, *strataColumns, datC1, datC2, *numPermutations)
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C stops the permutations; the ones finished so far are still used
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Running %d permutations for %d genes (seed %d)...\n", *numPermutations, len(dataC1.GeneIDs), *seed)
+	opts := connectivityOptions{Beta: *beta, Permutations: *numPermutations, Seed: *seed, Strata: strata,
+		Threads: *threads, Progress: os.Stderr}
+	genes, completed, runErr := geneConnectivityTest(ctx, datC1, datC2, colorh1C1C2, opts)
+	stop()
+	if err := adjustConnectivity(genes, *adjust); err != nil {
+		return err
+	}
+	rankConnectivity(genes)
+
+	comment := fmt.Sprintf("seed %d, %d permutations, beta %g", *seed, *numPermutations, *beta)
+	if strata != nil {
+		comment += fmt.Sprintf(", within strata of %s", strings.Join(strata.Columns, ", "))
+	}
+	if runErr != nil {
+		comment += fmt.Sprintf(", interrupted after %d", completed)
+	}
+	if err := saveGeneConnectivity(genes, comment, *adjust, *out); err != nil {
+		return err
+	}
+
+	if runErr != nil {
+		return fmt.Errorf("interrupted after %d of %d permutations, partial results saved to %s", completed, *numPermutations, *out)
+	}
+	fmt.Printf("Results saved to %s\n", *out)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestConnectivity(t *testing.T) {
+	cor := mat.NewSymDense(4, []float64{
+		1, 0.5, -0.5, 0.1,
+		0.5, 1, 0.2, 0,
+		-0.5, 0.2, 1, 0.3,
+		0.1, 0, 0.3, 1,
+	})
+	// Genes 0, 1 and 2 form a module, gene 3 is grey
+	within, total := connectivity(cor, [][]int{{0, 1, 2}}, 2)
+
+	wantWithin := []float64{0.5, 0.29, 0.29, math.NaN()}
+	wantTotal := []float64{0.51, 0.29, 0.38, 0.1}
+	for i := range wantTotal {
+		if math.Abs(total[i]-wantTotal[i]) > 1e-12 {
+			t.Errorf("total[%d] = %v, want %v", i, total[i], wantTotal[i])
+		}
+		if math.IsNaN(wantWithin[i]) != math.IsNaN(within[i]) || math.Abs(within[i]-wantWithin[i]) > 1e-12 {
+			t.Errorf("within[%d] = %v, want %v", i, within[i], wantWithin[i])
+		}
+	}
+
+	diff := scaledDifference([]float64{2, 1, 4}, []float64{1, 1, 0.5}, [][]int{{0, 1}})
+	if diff[0] != 0 || diff[1] != -0.5 || !math.IsNaN(diff[2]) {
+		t.Errorf("scaled difference = %v, want [0 -0.5 NaN]", diff)
+	}
+}
+
+func TestGeneConnectivityFindsRewiredGene(t *testing.T) {
+	// A module of 6 genes driven by one factor in both conditions, except gene 0 which follows the factor
+	// in condition 1 only
+	rng := rand.New(rand.NewSource(12))
+	genes := 8
+	geneIDs := make([]string, genes)
+	colorh1C1C2 := make(map[string]string)
+	for j := range geneIDs {
+		geneIDs[j] = "g" + strconv.Itoa(j)
+		if j < 6 {
+			colorh1C1C2[geneIDs[j]] = "blue"
+		}
+	}
+	condition := func(samples int, rewired bool) *labelledMatrix {
+		data := mat.NewDense(samples, genes, nil)
+		for i := 0; i < samples; i++ {
+			factor := rng.NormFloat64()
+			for j := 0; j < genes; j++ {
+				v := rng.NormFloat64()
+				if j < 6 && !(j == 0 && rewired) {
+					v = factor + 0.3*v
+				}
+				data.Set(i, j, v)
+			}
+		}
+		return &labelledMatrix{Data: data, GeneIDs: geneIDs}
+	}
+	datC1, datC2 := condition(20, false), condition(20, true)
+
+	result, completed, err := geneConnectivityTest(context.Background(), datC1, datC2, colorh1C1C2,
+		connectivityOptions{Beta: 2, Permutations: 200, Seed: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed != 200 {
+		t.Fatalf("completed = %d, want 200", completed)
+	}
+	if err := adjustConnectivity(result, "BH"); err != nil {
+		t.Fatal(err)
+	}
+	rankConnectivity(result)
+
+	if result[0].Gene != "g0" || result[0].ScaledKDiff <= 0 || result[0].PWithin > 0.01 {
+		t.Errorf("top gene = %+v, want g0 losing its connections in condition 2", result[0])
+	}
+	for _, g := range result[len(result)-2:] {
+		if g.Module != greyLabel || !math.IsNaN(g.PWithin) {
+			t.Errorf("gene %s (%s) ranked last, want the grey genes", g.Gene, g.Module)
+		}
+	}
+}
+
+func TestPermutedConnectivityMatchesMatrices(t *testing.T) {
+	datC1, datC2, colorh1C1C2 := randomConditions(5)
+	labels := colorsForGenes(datC1.GeneIDs, colorh1C1C2)
+	modules, columns := moduleColumns(labels)
+	members := make([][]int, len(modules))
+	for m, module := range modules {
+		members[m] = columns[module]
+	}
+	// A constant gene has a correlation of 0 with every other gene
+	rows1, _ := datC1.Data.Dims()
+	for i := 0; i < rows1; i++ {
+		datC1.Data.Set(i, 1, 2)
+	}
+
+	check := func(name string, within, total, wantWithin, wantTotal []float64) {
+		for i := range wantTotal {
+			if math.Abs(total[i]-wantTotal[i]) > 1e-12 {
+				t.Errorf("%s: total difference of gene %d = %v, want %v", name, i, total[i], wantTotal[i])
+			}
+			if math.IsNaN(wantWithin[i]) != math.IsNaN(within[i]) || math.Abs(within[i]-wantWithin[i]) > 1e-12 {
+				t.Errorf("%s: within difference of gene %d = %v, want %v", name, i, within[i], wantWithin[i])
+			}
+		}
+	}
+
+	within1, total1 := rankedConnectivity(rankedColumns(datC1.Data), members, 3)
+	within2, total2 := rankedConnectivity(rankedColumns(datC2.Data), members, 3)
+	within, total := connectivityDifferences(within1, total1, within2, total2, members)
+	wantWithin, wantTotal := differentialConnectivity(spearmanMatrix(datC1.Data), spearmanMatrix(datC2.Data), members, 3)
+	check("observed", within, total, wantWithin, wantTotal)
+
+	rows2, _ := datC2.Data.Dims()
+	d := combineAndScaleData(datC1.Data, datC2.Data)
+	for k := 0; k < 3; k++ {
+		permutation := randomPermutation(8, k, rows1+rows2, rows1)
+		within, total := permutedConnectivity(d, permutation, members, 3)
+		d1, d2 := splitRows(d, permutation)
+		wantWithin, wantTotal := differentialConnectivity(spearmanMatrix(d1), spearmanMatrix(d2), members, 3)
+		check("permutation "+strconv.Itoa(k), within, total, wantWithin, wantTotal)
+	}
+}
+
+// differentialConnectivity returns the scaled differences of the intramodular and of the whole network
+// connectivities between two correlation matrices, the reference for the matrix-free connectivities
+func differentialConnectivity(corC1, corC2 mat.Symmetric, members [][]int, beta float64) ([]float64, []float64) {
+	within1, total1 := connectivity(corC1, members, beta)
+	within2, total2 := connectivity(corC2, members, beta)
+
+	all := make([]int, len(total1))
+	for i := range all {
+		all[i] = i
+	}
+	return scaledDifference(within1, within2, members), scaledDifference(total1, total2, [][]int{all})
+}
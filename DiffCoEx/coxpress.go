@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"github.com/kcw27/PFS_Group_Project/multipletesting"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// coXpressResult is one row of the table returned by coXpress()
+type coXpressResult struct {
+	Group     string
+	N         int
+	T1        float64
+	T2        float64
+	PrG1      float64
+	PrG2      float64
+	MeanCorr1 float64
+	MeanCorr2 float64
+	MeanDiff  float64
+	// PrG1Adjusted and PrG2Adjusted are PrG1 and PrG2 corrected for multiple testing over all groups
+	PrG1Adjusted float64
+	PrG2Adjusted float64
+}
+
+// clusterGenes clusters genes like coXpress' cluster.gene(x, s = "pearson", m = method):
+// hierarchical clustering of 1 - Pearson correlation, where data has samples as rows and genes as columns
+func clusterGenes(data *mat.Dense, method string) (*Dendrogram, error) {
+	cor := pearsonMatrix(data)
+	n := cor.SymmetricDim()
+	dist := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			dist.SetSym(i, j, 1-cor.At(i, j))
+		}
+	}
+	return hierarchicalClustering(dist, method)
+}
+
+// groupStatistic returns the coXpress t statistic of a group of genes in one condition (samples x genes),
+// a one sample t statistic of the pairwise gene correlations against zero, along with their mean
+func groupStatistic(data *mat.Dense, genes []int) (float64, float64) {
+	columns := make([][]float64, len(genes))
+	for i, gene := range genes {
+		columns[i] = getColumn(data, gene)
+	}
+
+	var correlations []float64
+	for i := 0; i < len(genes); i++ {
+		for j := i + 1; j < len(genes); j++ {
+			correlations = append(correlations, stat.Correlation(columns[i], columns[j], nil))
+		}
+	}
+
+	mean, sd := stat.MeanStdDev(correlations, nil)
+	t := mean / (sd / math.Sqrt(float64(len(correlations))))
+	return t, mean
+}
+
+// randomGroupStatistics draws random groups of the given size from all genes of data and returns their
+// t statistics, like coXpress' create.dists
+func randomGroupStatistics(data *mat.Dense, size, times int, rng *rand.Rand) []float64 {
+	_, numGenes := data.Dims()
+	indices := make([]int, numGenes)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	stats := make([]float64, times)
+	for k := 0; k < times; k++ {
+		// Partial Fisher-Yates shuffle: the first size entries are a sample without replacement
+		for i := 0; i < size; i++ {
+			j := i + rng.Intn(numGenes-i)
+			indices[i], indices[j] = indices[j], indices[i]
+		}
+		stats[k], _ = groupStatistic(data, indices[:size])
+	}
+	return stats
+}
+
+// coXpress tests every group of at least 3 genes for coexpression in each condition (samples x genes).
+// The p-values pr.g1 and pr.g2 are the fractions of random groups of the same size whose t statistic
+// is at least as large as the group's. Results are sorted by decreasing mean.diff.
+func coXpress(datC1, datC2 *mat.Dense, groups []int, times int, rng *rand.Rand) []coXpressResult {
+	members := make(map[int][]int)
+	for i, group := range groups {
+		members[group] = append(members[group], i)
+	}
+
+	// Null distributions are shared by all groups of the same size
+	dists1 := make(map[int][]float64)
+	dists2 := make(map[int][]float64)
+	var sizes []int
+	for _, in := range members {
+		if len(in) >= 3 && dists1[len(in)] == nil {
+			dists1[len(in)] = []float64{}
+			sizes = append(sizes, len(in))
+		}
+	}
+	sort.Ints(sizes)
+	for _, size := range sizes {
+		dists1[size] = randomGroupStatistics(datC1, size, times, rng)
+		dists2[size] = randomGroupStatistics(datC2, size, times, rng)
+	}
+
+	fractionAtLeast := func(dist []float64, t float64) float64 {
+		count := 0
+		for _, v := range dist {
+			if v >= t {
+				count++
+			}
+		}
+		return float64(count) / float64(len(dist))
+	}
+
+	var results []coXpressResult
+	for group, in := range members {
+		if len(in) < 3 {
+			continue
+		}
+		t1, mean1 := groupStatistic(datC1, in)
+		t2, mean2 := groupStatistic(datC2, in)
+		results = append(results, coXpressResult{
+			Group:     strconv.Itoa(group),
+			N:         len(in),
+			T1:        t1,
+			T2:        t2,
+			PrG1:      fractionAtLeast(dists1[len(in)], t1),
+			PrG2:      fractionAtLeast(dists2[len(in)], t2),
+			MeanCorr1: mean1,
+			MeanCorr2: mean2,
+			MeanDiff:  mean1 - mean2,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].MeanDiff != results[j].MeanDiff {
+			return results[i].MeanDiff > results[j].MeanDiff
+		}
+		return results[i].Group < results[j].Group
+	})
+	return results
+}
+
+// adjustCoXpress corrects pr.g1 and pr.g2 for multiple testing, each over all groups
+func adjustCoXpress(results []coXpressResult, method string) error {
+	prG1 := make([]float64, len(results))
+	prG2 := make([]float64, len(results))
+	for i, r := range results {
+		prG1[i], prG2[i] = r.PrG1, r.PrG2
+	}
+	adjusted1, err := multipletesting.Adjust(prG1, method)
+	if err != nil {
+		return err
+	}
+	adjusted2, err := multipletesting.Adjust(prG2, method)
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		results[i].PrG1Adjusted, results[i].PrG2Adjusted = adjusted1[i], adjusted2[i]
+	}
+	return nil
+}
+
+// saveCoXpressTable writes the results in the layout of write.table on the coXpress data frame
+// (see cox_rat.txt): a header without a row name column, then the group as row name and every column.
+// The adjusted p-values follow the coXpress columns, named after the correction (pr.g1.BH, ...).
+func saveCoXpressTable(results []coXpressResult, method, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "group\tN\tt1\tt2\tpr.g1\tpr.g2\tmean.corr1\tmean.corr2\tmean.diff\tpr.g1.%s\tpr.g2.%s\n", method, method)
+	for _, r := range results {
+		_, err := fmt.Fprintf(file, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Group, r.Group, r.N,
+			formatR(r.T1), formatR(r.T2), formatR(r.PrG1), formatR(r.PrG2),
+			formatR(r.MeanCorr1), formatR(r.MeanCorr2), formatR(r.MeanDiff),
+			formatR(r.PrG1Adjusted), formatR(r.PrG2Adjusted))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatR formats a number with 15 significant digits, the way R writes doubles to text files
+func formatR(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', 15, 64)
+}
+
+// runCoXpress reproduces the coXpress half of clustering.R: cluster.gene on condition 1, cutree(h = 0.4)
+// and the coXpress resampling test of every group in both conditions
+func runCoXpress(args []string) error {
+	fs := flag.NewFlagSet("coxpress", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file, used for clustering (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	method := fs.String("method", "average", "linkage used by cluster.gene")
+	cutHeight := fs.Float64("h", 0.4, "cut the gene tree at this height (1 - correlation)")
+	times := fs.Int("times", 1000, "random groups drawn per group size")
+	seed := fs.Int64("seed", seedFromClock, "random seed (negative = seed from the clock)")
+	adjust := fs.String("adjust", "BH", "multiple testing correction of pr.g1 and pr.g2: "+strings.Join(multipletesting.Methods, ", "))
+	out := fs.String("out", "cox.txt", "output table")
+	groupsOut := fs.String("groups", "coxpress_groups.txt", "output gene to group file")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" {
+		fs.Usage()
+		return fmt.Errorf("both -c1 and -c2 are required")
+	}
+	if _, err := multipletesting.Adjust(nil, *adjust); err != nil {
+		return err
+	}
+	*seed = resolveSeed(*seed)
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	datC1 := samplesByGenes(dataC1.Data)
+	datC2 := samplesByGenes(dataC2.Data)
+
+	tree, err := clusterGenes(datC1, *method)
+	if err != nil {
+		return err
+	}
+	groups := tree.CutHeight(*cutHeight)
+
+	labels := make([]string, len(groups))
+	for i, group := range groups {
+		labels[i] = strconv.Itoa(group)
+	}
+	if err := genecolor.WriteFile(*groupsOut, dataC1.GeneIDs, labels); err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	results := coXpress(datC1, datC2, groups, *times, rng)
+	if err := adjustCoXpress(results, *adjust); err != nil {
+		return err
+	}
+	if err := saveCoXpressTable(results, *adjust, *out); err != nil {
+		return err
+	}
+	fmt.Printf("coXpress tested %d groups (seed %d). Files saved: %s, %s\n", len(results), *seed, *out, *groupsOut)
+	return nil
+}
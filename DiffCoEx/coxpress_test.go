@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestGroupStatistic(t *testing.T) {
+	// Pairwise correlations of the three genes are 1, 1/2 and 1/2
+	data := mat.NewDense(3, 3, []float64{
+		1, 1, 2,
+		2, 2, 1,
+		3, 3, 3,
+	})
+	tStat, mean := groupStatistic(data, []int{0, 1, 2})
+
+	wantMean := (1 + 0.5 + 0.5) / 3
+	if math.Abs(mean-wantMean) > 1e-12 {
+		t.Errorf("mean = %v, want %v", mean, wantMean)
+	}
+	sd := math.Sqrt(((1-wantMean)*(1-wantMean) + 2*(0.5-wantMean)*(0.5-wantMean)) / 2)
+	if want := wantMean / (sd / math.Sqrt(3)); math.Abs(tStat-want) > 1e-9 {
+		t.Errorf("t = %v, want %v", tStat, want)
+	}
+}
+
+func TestCoXpressFindsLostCoexpression(t *testing.T) {
+	// Genes 0-5 follow a shared signal in condition 1 only; the other genes are noise in both
+	rng := rand.New(rand.NewSource(1))
+	samples, genes := 30, 40
+	datC1 := mat.NewDense(samples, genes, nil)
+	datC2 := mat.NewDense(samples, genes, nil)
+	for i := 0; i < samples; i++ {
+		signal := rng.NormFloat64()
+		for j := 0; j < genes; j++ {
+			datC1.Set(i, j, rng.NormFloat64())
+			datC2.Set(i, j, rng.NormFloat64())
+			if j < 6 {
+				datC1.Set(i, j, signal+0.1*rng.NormFloat64())
+			}
+		}
+	}
+
+	tree, err := clusterGenes(datC1, "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := tree.CutHeight(0.4)
+	for j := 1; j < 6; j++ {
+		if groups[j] != groups[0] {
+			t.Fatalf("planted genes split over groups %v", groups[:6])
+		}
+	}
+
+	results := coXpress(datC1, datC2, groups, 200, rng)
+	if len(results) == 0 || results[0].Group != strconv.Itoa(groups[0]) {
+		t.Fatalf("results = %+v, want the planted group first", results)
+	}
+	top := results[0]
+	if top.PrG1 != 0 || top.PrG2 < 0.01 || top.MeanCorr1 < 0.9 || top.MeanDiff <= 0 {
+		t.Errorf("planted group = %+v", top)
+	}
+	for _, r := range results[1:] {
+		if r.MeanDiff > top.MeanDiff {
+			t.Errorf("results not sorted by mean.diff: %+v", results)
+		}
+	}
+}
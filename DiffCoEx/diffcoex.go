@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"gonum.org/v1/gonum/mat"
+)
+
+// diffCoExOptions are the user defined parameters of the DiffCoEx module detection
+type diffCoExOptions struct {
+	Beta        float64
+	Threads     int
+	Cut         dynamicCutOptions
+	MergeHeight float64
+}
+
+// diffCoExModules runs the module detection of Tesson et al. on two conditions (samples x genes):
+// adjacency matrices, TOM of the adjacency difference, average linkage clustering, hybrid dynamic
+// tree cut, color labelling and merging of close modules. It returns the gene tree together with
+// the merged modules.
+func diffCoExModules(datC1, datC2 *mat.Dense, opts diffCoExOptions) (*Dendrogram, *mergedModules, error) {
+	fmt.Println("Building adjacency matrices...")
+	adjC1 := conditionAdjacency(datC1)
+	adjC2 := conditionAdjacency(datC2)
+	diff := differentialAdjacency(adjC1, adjC2, opts.Beta)
+
+	fmt.Println("Computing topological overlap...")
+	dissTOM := tomDist(diff, false, opts.Threads)
+
+	fmt.Println("Clustering genes...")
+	tree, err := hierarchicalClustering(dissTOM, "average")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Println("Cutting the tree into modules...")
+	labels, err := cutreeHybrid(tree, dissTOM, opts.Cut)
+	if err != nil {
+		return nil, nil, err
+	}
+	colors := labels2colors(labels)
+
+	fmt.Println("Merging close modules...")
+	merged, err := mergeCloseModules(stackConditions(datC1, datC2), colors, opts.MergeHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, merged, nil
+}
+
+// runDiffCoEx produces a gene module file from two condition files without R, chaining the steps of
+// clustering.R from the adjacency matrices to mergeCloseModules
+func runDiffCoEx(args []string) error {
+	fs := flag.NewFlagSet("diffcoex", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	beta := fs.Float64("beta", defaultBeta, "soft thresholding power")
+	threads := fs.Int("threads", 0, "goroutines used for the topological overlap (0 = all CPUs)")
+	defaults := diffCoExCutOptions()
+	cutHeight := fs.Float64("cutheight", defaults.CutHeight, "maximum joining height for the dynamic tree cut")
+	minSize := fs.Int("minsize", defaults.MinClusterSize, "minimum module size")
+	deepSplit := fs.Int("deepsplit", defaults.DeepSplit, "deepSplit, 0 to 4 (R's TRUE is 3)")
+	pamDendro := fs.Bool("pamdendro", defaults.PamRespectsDendro, "PAM stage only assigns genes within their own branch (pamRespectsDendro)")
+	mergeHeight := fs.Float64("mergeheight", 0.2, "merge modules whose eigengene dissimilarity is below this height")
+	out := fs.String("out", "module_colors.txt", "output gene module file (\"gene color\" per line)")
+	newick := fs.String("newick", "", "also write the gene dendrogram in Newick format to this file")
+	eigengenesOut := fs.String("eigengenes", "", "also write the module eigengenes to this file")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" {
+		fs.Usage()
+		return fmt.Errorf("both -c1 and -c2 are required")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+
+	opts := diffCoExOptions{
+		Beta:    *beta,
+		Threads: *threads,
+		Cut: dynamicCutOptions{
+			CutHeight:         *cutHeight,
+			MinClusterSize:    *minSize,
+			DeepSplit:         *deepSplit,
+			PamStage:          true,
+			PamRespectsDendro: *pamDendro,
+		},
+		MergeHeight: *mergeHeight,
+	}
+	tree, merged, err := diffCoExModules(samplesByGenes(dataC1.Data), samplesByGenes(dataC2.Data), opts)
+	if err != nil {
+		return err
+	}
+
+	if err := genecolor.WriteFile(*out, dataC1.GeneIDs, merged.Labels); err != nil {
+		return err
+	}
+	if *newick != "" {
+		tree.Labels = dataC1.GeneIDs
+		if err := os.WriteFile(*newick, []byte(tree.Newick()+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if *eigengenesOut != "" {
+		if err := saveEigengenes(merged, dataC1.Data, *eigengenesOut); err != nil {
+			return err
+		}
+	}
+
+	sizes := make(map[string]int)
+	for _, color := range merged.Labels {
+		sizes[color]++
+	}
+	fmt.Printf("DiffCoEx found %d modules (%d genes unassigned). Module assignment saved to %s\n",
+		len(merged.Modules), sizes[greyLabel], *out)
+	return nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// dynamicCutOptions are the parameters of cutreeDynamic(method = "hybrid")
+type dynamicCutOptions struct {
+	// CutHeight is the maximum joining height for a cluster. Values <= 0 use the R default of
+	// 99% of the range between the 5th percentile of merge heights and the maximum height.
+	CutHeight      float64
+	MinClusterSize int
+	// DeepSplit controls the sensitivity to splitting, from 0 to 4. R's deepSplit = TRUE is 3.
+	DeepSplit         int
+	PamStage          bool
+	PamRespectsDendro bool
+}
+
+// diffCoExCutOptions returns the cutreeDynamic parameters used by Tesson et al.:
+// cutHeight = .996, deepSplit = TRUE, pamRespectsDendro = FALSE, minClusterSize = 20
+func diffCoExCutOptions() dynamicCutOptions {
+	return dynamicCutOptions{
+		CutHeight:         0.996,
+		MinClusterSize:    20,
+		DeepSplit:         3,
+		PamStage:          true,
+		PamRespectsDendro: false,
+	}
+}
+
+// treeBranch tracks one branch of the dendrogram while the merges are replayed
+type treeBranch struct {
+	isBasic    bool
+	isTopBasic bool
+	failSize   bool
+	size       int
+	// singletons are the observations of a basic branch in the order they joined it
+	singletons []int
+	// basicClusters are the basic branches making up a composite branch
+	basicClusters []int
+	attachHeight  float64
+}
+
+// coreSize returns the number of observations that make up the core of a branch (.CoreSize in R)
+func coreSize(branchSize, minClusterSize int) int {
+	baseCoreSize := float64(minClusterSize)/2 + 1
+	if baseCoreSize < float64(branchSize) {
+		return int(baseCoreSize + math.Sqrt(float64(branchSize)-baseCoreSize))
+	}
+	return branchSize
+}
+
+// coreScatter returns the average distance between the core observations of a basic branch
+func coreScatter(singletons []int, minClusterSize int, dist mat.Symmetric) float64 {
+	size := coreSize(len(singletons), minClusterSize)
+	if size < 2 {
+		return 0
+	}
+	core := singletons[:size]
+
+	var sum float64
+	for _, i := range core {
+		for _, j := range core {
+			sum += dist.At(i, j)
+		}
+	}
+	return sum / float64(size) / float64(size-1)
+}
+
+// cutreeHybrid ports the hybrid dynamic tree cut of the dynamicTreeCut R package. It returns one
+// label per observation: 0 for unassigned observations and 1, 2, ... for clusters in order of
+// decreasing size, as cutreeDynamic does.
+func cutreeHybrid(tree *Dendrogram, dist mat.Symmetric, opts dynamicCutOptions) ([]int, error) {
+	nPoints := tree.NumLeaves()
+	nMerge := len(tree.Merge)
+	if dist.SymmetricDim() != nPoints {
+		return nil, fmt.Errorf("distance matrix has %d rows but the tree has %d leaves", dist.SymmetricDim(), nPoints)
+	}
+	if opts.DeepSplit < 0 || opts.DeepSplit > 4 {
+		return nil, fmt.Errorf("deepSplit must be between 0 and 4, got %d", opts.DeepSplit)
+	}
+	if opts.MinClusterSize < 1 {
+		return nil, fmt.Errorf("minClusterSize must be positive, got %d", opts.MinClusterSize)
+	}
+
+	// Reference height: the merge height at the 5th percentile
+	refMerge := int(math.Round(float64(nMerge) * 0.05))
+	if refMerge < 1 {
+		refMerge = 1
+	}
+	refHeight := tree.Height[refMerge-1]
+
+	maxHeight := tree.Height[nMerge-1]
+	cutHeight := opts.CutHeight
+	if cutHeight <= 0 {
+		cutHeight = 0.99*(maxHeight-refHeight) + refHeight
+	} else if cutHeight > maxHeight {
+		cutHeight = maxHeight
+	}
+
+	// Like R, give up when there are fewer merges below the cut than minClusterSize
+	mergesBelowCut := 0
+	for _, height := range tree.Height {
+		if height <= cutHeight {
+			mergesBelowCut++
+		}
+	}
+	if mergesBelowCut < opts.MinClusterSize {
+		return make([]int, nPoints), nil
+	}
+
+	defaultMaxCoreScatter := []float64{0.64, 0.73, 0.82, 0.91, 0.95}
+	maxCoreScatter := defaultMaxCoreScatter[opts.DeepSplit]
+	minGap := (1 - maxCoreScatter) * 3 / 4
+	maxAbsCoreScatter := refHeight + maxCoreScatter*(cutHeight-refHeight)
+	minAbsGap := minGap * (cutHeight - refHeight)
+	// R's default minSplitHeight is 0, so refHeight + minSplitHeight * (cutHeight - refHeight) is refHeight
+	minAbsSplitHeight := refHeight
+	maxPamDist := cutHeight
+
+	var branches []*treeBranch
+	mergeToBranch := make([]int, nMerge)
+	// onBranch records the composite branch an observation joined directly (-1 if none)
+	onBranch := make([]int, nPoints)
+	for i := range onBranch {
+		onBranch[i] = -1
+	}
+
+	for merge := 0; merge < nMerge; merge++ {
+		height := tree.Height[merge]
+		if height > cutHeight {
+			continue
+		}
+		left, right := tree.Merge[merge][0], tree.Merge[merge][1]
+
+		switch {
+		case left < 0 && right < 0:
+			// Two observations start a new basic branch
+			branches = append(branches, &treeBranch{
+				isBasic:      true,
+				isTopBasic:   true,
+				size:         2,
+				singletons:   []int{-left - 1, -right - 1},
+				attachHeight: math.NaN(),
+			})
+			mergeToBranch[merge] = len(branches) - 1
+
+		case left < 0 || right < 0:
+			// An observation joins an existing branch
+			if left > 0 {
+				left, right = right, left
+			}
+			gene, clust := -left-1, mergeToBranch[right-1]
+			branch := branches[clust]
+			if branch.isBasic {
+				branch.singletons = append(branch.singletons, gene)
+			} else {
+				onBranch[gene] = clust
+			}
+			branch.size++
+			mergeToBranch[merge] = clust
+
+		default:
+			// Two branches meet: either the smaller one is absorbed or they become a composite branch
+			small, large := mergeToBranch[left-1], mergeToBranch[right-1]
+			if branches[large].size < branches[small].size {
+				small, large = large, small
+			}
+
+			var smallScatter, largeScatter float64
+			if branches[small].isBasic {
+				smallScatter = coreScatter(branches[small].singletons, opts.MinClusterSize, dist)
+			}
+			if branches[large].isBasic {
+				largeScatter = coreScatter(branches[large].singletons, opts.MinClusterSize, dist)
+			}
+
+			doMerge := false
+			smallerFailSize := false
+			smallFails := branches[small].size < opts.MinClusterSize || smallScatter > maxAbsCoreScatter ||
+				height-smallScatter < minAbsGap || height < minAbsSplitHeight
+			largeFails := branches[large].size < opts.MinClusterSize || largeScatter > maxAbsCoreScatter ||
+				height-largeScatter < minAbsGap || height < minAbsSplitHeight
+			if branches[small].isBasic && smallFails {
+				doMerge = true
+				smallerFailSize = !(smallScatter > maxAbsCoreScatter || height-smallScatter < minAbsGap)
+			} else if branches[large].isBasic && largeFails {
+				// Only checked when the smaller branch passes, and then the larger one is merged into the
+				// smaller one (LargerScores in R)
+				doMerge = true
+				smallerFailSize = !(largeScatter > maxAbsCoreScatter || height-largeScatter < minAbsGap)
+				small, large = large, small
+			}
+
+			if doMerge {
+				// Absorb the failing branch into the other one
+				sb, lb := branches[small], branches[large]
+				sb.failSize = smallerFailSize
+				sb.attachHeight = height
+				sb.isTopBasic = false
+				if lb.isBasic {
+					lb.singletons = append(lb.singletons, sb.singletons...)
+				} else {
+					for _, gene := range sb.singletons {
+						onBranch[gene] = large
+					}
+				}
+				lb.size += sb.size
+				mergeToBranch[merge] = large
+				continue
+			}
+
+			// Start or extend a composite branch
+			if branches[large].isBasic && !branches[small].isBasic {
+				small, large = large, small
+			}
+			sb, lb := branches[small], branches[large]
+			addBasic := sb.basicClusters
+			if sb.isBasic {
+				addBasic = []int{small}
+			}
+
+			if lb.isBasic || (opts.PamStage && opts.PamRespectsDendro) {
+				basic := append([]int{}, addBasic...)
+				if lb.isBasic {
+					basic = append(basic, large)
+				} else {
+					basic = append(basic, lb.basicClusters...)
+				}
+				sb.attachHeight = height
+				lb.attachHeight = height
+				branches = append(branches, &treeBranch{
+					size:          sb.size + lb.size,
+					basicClusters: basic,
+					attachHeight:  math.NaN(),
+				})
+				mergeToBranch[merge] = len(branches) - 1
+			} else {
+				lb.basicClusters = append(lb.basicClusters, addBasic...)
+				lb.size += sb.size
+				sb.attachHeight = height
+				mergeToBranch[merge] = large
+			}
+		}
+	}
+
+	// Decide which top basic branches are clusters
+	labels := make([]int, nPoints)
+	smallLabels := make([]int, nPoints)
+	branchLabels := make([]int, len(branches))
+	isCluster := make([]bool, len(branches))
+	for b, branch := range branches {
+		if math.IsNaN(branch.attachHeight) {
+			branch.attachHeight = cutHeight
+		}
+		if branch.isTopBasic {
+			scatter := coreScatter(branch.singletons, opts.MinClusterSize, dist)
+			isCluster[b] = branch.size >= opts.MinClusterSize && scatter < maxAbsCoreScatter &&
+				branch.attachHeight-scatter > minAbsGap
+		}
+		if branch.failSize {
+			for _, gene := range branch.singletons {
+				smallLabels[gene] = b + 1
+			}
+		}
+	}
+
+	nLabels := 0
+	for b, branch := range branches {
+		if !isCluster[b] {
+			continue
+		}
+		nLabels++
+		for _, gene := range branch.singletons {
+			labels[gene] = nLabels
+			smallLabels[gene] = 0
+		}
+		branchLabels[b] = nLabels
+	}
+
+	if opts.PamStage && nLabels > 0 {
+		pamAssign(labels, smallLabels, onBranch, branches, branchLabels, nLabels, dist, maxPamDist, opts.PamRespectsDendro)
+	}
+
+	return relabelBySize(labels), nil
+}
+
+// pamAssign is the PAM-like stage of the hybrid cut: unassigned observations (first whole small
+// branches, then single observations) join the cluster with the smallest average distance if it
+// is close enough
+func pamAssign(labels, smallLabels, onBranch []int, branches []*treeBranch, branchLabels []int, nLabels int,
+	dist mat.Symmetric, maxPamDist float64, respectsDendro bool) {
+	nPoints := len(labels)
+	assigned := append([]int{}, labels...)
+
+	// Cluster diameter: the largest average distance of a member to the rest of its cluster
+	diameter := make([]float64, nLabels+1)
+	members := make([][]int, nLabels+1)
+	for i, label := range assigned {
+		if label > 0 {
+			members[label] = append(members[label], i)
+		}
+	}
+	for label := 1; label <= nLabels; label++ {
+		in := members[label]
+		if len(in) < 2 {
+			continue
+		}
+		for _, i := range in {
+			var sum float64
+			for _, j := range in {
+				sum += dist.At(i, j)
+			}
+			diameter[label] = math.Max(diameter[label], sum/float64(len(in)-1))
+		}
+	}
+
+	// candidateLabels lists the clusters an observation on the given branch may join
+	candidateLabels := func(branch int) map[int]bool {
+		candidates := make(map[int]bool)
+		if !respectsDendro {
+			for label := 1; label <= nLabels; label++ {
+				candidates[label] = true
+			}
+			return candidates
+		}
+		if branch < 0 {
+			return candidates
+		}
+		for _, basic := range branches[branch].basicClusters {
+			if branchLabels[basic] > 0 {
+				candidates[branchLabels[basic]] = true
+			}
+		}
+		return candidates
+	}
+
+	// nearestCluster returns the candidate cluster with the smallest average distance to the observations
+	nearestCluster := func(objects []int, candidates map[int]bool) (int, float64) {
+		best, bestDist := 0, math.Inf(1)
+		for label := 1; label <= nLabels; label++ {
+			if !candidates[label] || len(members[label]) == 0 {
+				continue
+			}
+			var sum float64
+			for _, i := range objects {
+				for _, j := range members[label] {
+					sum += dist.At(i, j)
+				}
+			}
+			mean := sum / float64(len(objects)*len(members[label]))
+			if mean < bestDist {
+				best, bestDist = label, mean
+			}
+		}
+		return best, bestDist
+	}
+
+	// Small branches that failed only on size are assigned as a whole
+	smallGroups := make(map[int][]int)
+	var smallIDs []int
+	for i, label := range smallLabels {
+		if label > 0 {
+			if _, ok := smallGroups[label]; !ok {
+				smallIDs = append(smallIDs, label)
+			}
+			smallGroups[label] = append(smallGroups[label], i)
+		}
+	}
+	sort.Ints(smallIDs)
+	for _, id := range smallIDs {
+		in := smallGroups[id]
+		label, d := nearestCluster(in, candidateLabels(onBranch[in[0]]))
+		if label > 0 && (d < diameter[label] || d < maxPamDist) {
+			for _, i := range in {
+				labels[i] = label
+			}
+		} else {
+			// Keep the group together: its members are not assigned one by one later
+			for _, i := range in {
+				labels[i] = -1
+			}
+		}
+	}
+
+	for i := 0; i < nPoints; i++ {
+		if labels[i] != 0 {
+			continue
+		}
+		label, d := nearestCluster([]int{i}, candidateLabels(onBranch[i]))
+		if label > 0 && (d < diameter[label] || d < maxPamDist) {
+			labels[i] = label
+		}
+	}
+
+	for i := range labels {
+		if labels[i] < 0 {
+			labels[i] = 0
+		}
+	}
+}
+
+// relabelBySize renumbers clusters so that 1 is the largest, keeping 0 for unassigned observations.
+// Ties keep the original order.
+func relabelBySize(labels []int) []int {
+	sizes := make(map[int]int)
+	var ids []int
+	for _, label := range labels {
+		if label == 0 {
+			continue
+		}
+		if _, ok := sizes[label]; !ok {
+			ids = append(ids, label)
+		}
+		sizes[label]++
+	}
+	sort.Ints(ids)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return sizes[ids[i]] > sizes[ids[j]]
+	})
+
+	newLabel := make(map[int]int)
+	for rank, id := range ids {
+		newLabel[id] = rank + 1
+	}
+	relabelled := make([]int, len(labels))
+	for i, label := range labels {
+		relabelled[i] = newLabel[label]
+	}
+	return relabelled
+}
@@ -0,0 +1,150 @@
+package main
+
+import "testing"
+
+func TestCutreeHybridFindsSeparatedClusters(t *testing.T) {
+	// Three tight groups of 25, 30 and 22 points on a line, far apart from each other
+	var points []float64
+	for i := 0; i < 25; i++ {
+		points = append(points, 0+0.01*float64(i))
+	}
+	for i := 0; i < 30; i++ {
+		points = append(points, 5+0.01*float64(i))
+	}
+	for i := 0; i < 22; i++ {
+		points = append(points, 9+0.01*float64(i))
+	}
+	dist := lineDistances(points)
+
+	tree, err := hierarchicalClustering(dist, "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := diffCoExCutOptions()
+	opts.CutHeight = 0
+	labels, err := cutreeHybrid(tree, dist, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clusters are numbered by decreasing size
+	for i, label := range labels {
+		want := 2
+		switch {
+		case i >= 25 && i < 55:
+			want = 1
+		case i >= 55:
+			want = 3
+		}
+		if label != want {
+			t.Fatalf("labels = %v", labels)
+		}
+	}
+}
+
+func TestCutreeHybridLeavesSmallGroupsUnassigned(t *testing.T) {
+	// One group of 25 points and a far away group of 5, which is below minClusterSize
+	var points []float64
+	for i := 0; i < 25; i++ {
+		points = append(points, 0.01*float64(i))
+	}
+	for i := 0; i < 5; i++ {
+		points = append(points, 50+0.01*float64(i))
+	}
+	dist := lineDistances(points)
+
+	tree, err := hierarchicalClustering(dist, "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := diffCoExCutOptions()
+	opts.CutHeight = 0
+	labels, err := cutreeHybrid(tree, dist, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, label := range labels {
+		if (i < 25 && label != 1) || (i >= 25 && label != 0) {
+			t.Fatalf("labels = %v", labels)
+		}
+	}
+}
+
+// cutreeFixture is a dendrogram of 35 points on a line and the labels of the hybrid cut for deepSplit 0
+// to 3 (minClusterSize = 4, pamStage = TRUE). R was not available when the labels were written down, so
+// they come from tracing dynamicTreeCut's cutreeHybrid source by hand on this tree, not from running it.
+// The groups at 0.6 and 4.3 split off only at higher deepSplit, and at deepSplit 1 the diffuse branch
+// between 3.3 and 3.9 is merged into the tighter, smaller one at 4.3. To check the labels in R:
+//
+//	d <- dist(points)
+//	for (ds in 0:3) print(cutreeDynamic(hclust(d, "average"), distM = as.matrix(d), deepSplit = ds,
+//	    minClusterSize = 4, pamStage = TRUE, pamRespectsDendro = FALSE))
+var cutreeFixture = struct {
+	points []float64
+	labels [4][]int
+}{
+	points: []float64{
+		0.0025, 0.0258, 0.0579, 0.0828, 0.1078, 0.6161, 0.6313, 0.658, 0.7046, 0.7247, 1.01, 1.0233,
+		1.0424, 1.0809, 1.1179, 1.1405, 1.5943, 1.6213, 1.6636, 2.5133, 2.5373, 2.5492, 2.6129, 2.6218,
+		3.3023, 3.4125, 3.49, 3.6174, 3.6942, 3.8243, 3.9096, 4.3174, 4.3178, 4.3542, 4.3608,
+	},
+	labels: [4][]int{
+		{4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+		{4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+		{4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 2, 2, 2, 2, 2, 2, 2, 5, 5, 5, 5},
+		{5, 5, 5, 5, 5, 4, 4, 4, 4, 4, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 2, 2, 2, 2, 2, 2, 2, 6, 6, 6, 6},
+	},
+}
+
+func TestCutreeHybridDeepSplit(t *testing.T) {
+	dist := lineDistances(cutreeFixture.points)
+	tree, err := hierarchicalClustering(dist, "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deepSplit, want := range cutreeFixture.labels {
+		// The PAM stage gives the same labels whether or not it respects the dendrogram
+		for _, respectsDendro := range []bool{false, true} {
+			opts := dynamicCutOptions{MinClusterSize: 4, DeepSplit: deepSplit, PamStage: true, PamRespectsDendro: respectsDendro}
+			labels, err := cutreeHybrid(tree, dist, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				if labels[i] != want[i] {
+					t.Fatalf("deepSplit %d, pamRespectsDendro %v: labels = %v, want %v", deepSplit, respectsDendro, labels, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCutreeHybridTooFewMergesBelowCut(t *testing.T) {
+	// Only the 3 merges of the first group are below the cut, fewer than minClusterSize, so cutreeHybrid
+	// gives up and leaves every point unassigned
+	dist := lineDistances([]float64{0, 0.01, 0.025, 0.04, 5, 5.3, 10})
+	tree, err := hierarchicalClustering(dist, "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := cutreeHybrid(tree, dist, dynamicCutOptions{CutHeight: 0.05, MinClusterSize: 4, DeepSplit: 3, PamStage: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range labels {
+		if label != 0 {
+			t.Fatalf("labels = %v, want all 0", labels)
+		}
+	}
+}
+
+func TestCoreSize(t *testing.T) {
+	// BaseCoreSize for minClusterSize 20 is 11
+	if got := coreSize(5, 20); got != 5 {
+		t.Errorf("coreSize(5, 20) = %d, want 5", got)
+	}
+	if got := coreSize(36, 20); got != 16 {
+		t.Errorf("coreSize(36, 20) = %d, want 16", got)
+	}
+}
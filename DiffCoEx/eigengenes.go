@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// greyLabel marks genes that do not belong to any module
+const greyLabel = "grey"
+
+// moduleMerge records one module being merged into another by mergeCloseModules
+type moduleMerge struct {
+	Iteration int
+	From      string
+	Into      string
+	// Dissimilarity is 1 - cor between the two module eigengenes when they were merged
+	Dissimilarity float64
+}
+
+// mergedModules is the result of mergeCloseModules
+type mergedModules struct {
+	Labels []string
+	// Eigengenes has one row per sample and one column per module in Modules
+	Eigengenes *mat.Dense
+	Modules    []string
+	Log        []moduleMerge
+}
+
+// moduleEigengene returns the first principal component of the given gene columns of data (samples x genes),
+// as computed by WGCNA's moduleEigengenes: every gene is scaled to mean 0 and variance 1, and the sign of
+// the component is chosen so that it correlates positively with the average scaled expression
+func moduleEigengene(data *mat.Dense, genes []int) ([]float64, error) {
+	rows, _ := data.Dims()
+	module := mat.NewDense(rows, len(genes), nil)
+	for j, gene := range genes {
+		module.SetCol(j, getColumn(data, gene))
+	}
+	module = scaleData(module)
+
+	var svd mat.SVD
+	if !svd.Factorize(module, mat.SVDThinU) {
+		return nil, fmt.Errorf("singular value decomposition failed")
+	}
+	var u mat.Dense
+	svd.UTo(&u)
+	eigengene := getColumn(&u, 0)
+
+	average := make([]float64, rows)
+	for i := 0; i < rows; i++ {
+		average[i] = meanFloat(module.RawRowView(i))
+	}
+	if stat.Correlation(average, eigengene, nil) < 0 {
+		for i := range eigengene {
+			eigengene[i] = -eigengene[i]
+		}
+	}
+	return eigengene, nil
+}
+
+// moduleColumns groups the gene columns by label, leaving out grey. The modules are returned in
+// alphabetical order, which is the order WGCNA uses for its eigengene matrix.
+func moduleColumns(labels []string) ([]string, map[string][]int) {
+	columns := make(map[string][]int)
+	for i, label := range labels {
+		if label != greyLabel {
+			columns[label] = append(columns[label], i)
+		}
+	}
+	modules := make([]string, 0, len(columns))
+	for module := range columns {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	return modules, columns
+}
+
+// moduleEigengenes computes the eigengene of every non-grey module, one column per module
+func moduleEigengenes(data *mat.Dense, labels []string) (*mat.Dense, []string, error) {
+	rows, _ := data.Dims()
+	modules, columns := moduleColumns(labels)
+	if len(modules) == 0 {
+		return nil, nil, fmt.Errorf("no modules besides %s", greyLabel)
+	}
+
+	eigengenes := mat.NewDense(rows, len(modules), nil)
+	for j, module := range modules {
+		eigengene, err := moduleEigengene(data, columns[module])
+		if err != nil {
+			return nil, nil, fmt.Errorf("module %s: %v", module, err)
+		}
+		eigengenes.SetCol(j, eigengene)
+	}
+	return eigengenes, modules, nil
+}
+
+// mergeCloseModules repeatedly clusters the module eigengenes of data (samples x genes, both conditions
+// stacked as in rbind(datC1, datC2)) by 1 - cor with average linkage and merges modules that join below
+// cutHeight, like WGCNA's mergeCloseModules. Within each group of close modules the genes take the label
+// of the largest module (ties go to the alphabetically first one). Grey genes are left untouched.
+func mergeCloseModules(data *mat.Dense, labels []string, cutHeight float64) (*mergedModules, error) {
+	merged := append([]string{}, labels...)
+	var mergeLog []moduleMerge
+
+	for iteration := 1; ; iteration++ {
+		eigengenes, modules, err := moduleEigengenes(data, merged)
+		if err != nil {
+			return nil, err
+		}
+		if len(modules) < 2 {
+			return &mergedModules{Labels: merged, Eigengenes: eigengenes, Modules: modules, Log: mergeLog}, nil
+		}
+
+		diss := eigengeneDissimilarity(eigengenes)
+		tree, err := hierarchicalClustering(diss, "average")
+		if err != nil {
+			return nil, err
+		}
+		groups := tree.CutHeight(cutHeight)
+
+		_, columns := moduleColumns(merged)
+		members := make(map[int][]int)
+		for m, group := range groups {
+			members[group] = append(members[group], m)
+		}
+
+		rename := make(map[string]string)
+		for g := 1; g <= len(members); g++ {
+			group := members[g]
+			if len(group) < 2 {
+				continue
+			}
+			// modules are sorted, so on equal sizes the first one in the group wins
+			into := group[0]
+			for _, m := range group[1:] {
+				if len(columns[modules[m]]) > len(columns[modules[into]]) {
+					into = m
+				}
+			}
+			for _, m := range group {
+				if m == into {
+					continue
+				}
+				rename[modules[m]] = modules[into]
+				mergeLog = append(mergeLog, moduleMerge{
+					Iteration:     iteration,
+					From:          modules[m],
+					Into:          modules[into],
+					Dissimilarity: diss.At(m, into),
+				})
+			}
+		}
+
+		if len(rename) == 0 {
+			return &mergedModules{Labels: merged, Eigengenes: eigengenes, Modules: modules, Log: mergeLog}, nil
+		}
+		for i, label := range merged {
+			if into, ok := rename[label]; ok {
+				merged[i] = into
+			}
+		}
+	}
+}
+
+// eigengeneDissimilarity returns 1 - cor between every pair of eigengene columns
+func eigengeneDissimilarity(eigengenes *mat.Dense) *mat.SymDense {
+	_, n := eigengenes.Dims()
+	diss := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			diss.SetSym(i, j, 1-stat.Correlation(getColumn(eigengenes, i), getColumn(eigengenes, j), nil))
+		}
+	}
+	return diss
+}
+
+// stackConditions stacks the two condition matrices (samples x genes) like rbind(datC1, datC2)
+func stackConditions(datC1, datC2 *mat.Dense) *mat.Dense {
+	var stacked mat.Dense
+	stacked.Stack(datC1, datC2)
+	return &stacked
+}
+
+// saveEigengenes writes the eigengene matrix with one row per sample. Samples are named C1_1, C1_2, ...
+// and C2_1, C2_2, ..., where dataC1 (genes x samples) gives the number of condition 1 samples.
+func saveEigengenes(result *mergedModules, dataC1 *mat.Dense, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	header := []string{"sample"}
+	for _, module := range result.Modules {
+		header = append(header, "ME"+module)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	_, samplesC1 := dataC1.Dims()
+	rows, cols := result.Eigengenes.Dims()
+	for i := 0; i < rows; i++ {
+		row := make([]string, cols+1)
+		if i < samplesC1 {
+			row[0] = fmt.Sprintf("C1_%d", i+1)
+		} else {
+			row[0] = fmt.Sprintf("C2_%d", i-samplesC1+1)
+		}
+		for j := 0; j < cols; j++ {
+			row[j+1] = strconv.FormatFloat(result.Eigengenes.At(i, j), 'g', -1, 64)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveMergeLog writes the merges performed by mergeCloseModules as a tab separated table
+func saveMergeLog(mergeLog []moduleMerge, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, "iteration\tfrom\tinto\tdissimilarity")
+	for _, m := range mergeLog {
+		if _, err := fmt.Fprintf(file, "%d\t%s\t%s\t%g\n", m.Iteration, m.From, m.Into, m.Dissimilarity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestMergeCloseModules(t *testing.T) {
+	// 8 samples x 7 genes: "blue" and "red" follow the same signal, "green" an unrelated one,
+	// and the last gene is grey
+	signal := []float64{1, 3, 2, 5, 4, 7, 6, 8}
+	other := []float64{5, 1, 4, 2, 8, 3, 7, 6}
+	data := mat.NewDense(8, 7, nil)
+	for i := 0; i < 8; i++ {
+		data.Set(i, 0, signal[i])
+		data.Set(i, 1, 2*signal[i]+0.1*float64(i%2))
+		data.Set(i, 2, signal[i]+0.2*float64(i%3))
+		data.Set(i, 3, -signal[i]*0.5+10)
+		data.Set(i, 4, other[i])
+		data.Set(i, 5, other[i]*3+0.1*float64(i%2))
+		data.Set(i, 6, float64(i))
+	}
+	labels := []string{"blue", "blue", "red", "blue", "green", "green", "grey"}
+
+	result, err := mergeCloseModules(data, labels, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"blue", "blue", "blue", "blue", "green", "green", "grey"}
+	for i := range want {
+		if result.Labels[i] != want[i] {
+			t.Fatalf("Labels = %v, want %v", result.Labels, want)
+		}
+	}
+	if len(result.Log) != 1 || result.Log[0].From != "red" || result.Log[0].Into != "blue" {
+		t.Errorf("Log = %+v, want red merged into blue", result.Log)
+	}
+	if len(result.Modules) != 2 || result.Modules[0] != "blue" || result.Modules[1] != "green" {
+		t.Errorf("Modules = %v, want [blue green]", result.Modules)
+	}
+
+	// The eigengene is aligned with the average expression, so it follows the signal
+	blue := getColumn(result.Eigengenes, 0)
+	var norm float64
+	for _, v := range blue {
+		norm += v * v
+	}
+	if math.Abs(norm-1) > 1e-9 || blue[7] < blue[0] {
+		t.Errorf("blue eigengene = %v", blue)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// seedFromClock is the -seed default of the commands that draw random numbers. It is not a valid seed,
+// so every seed given on the command line, 0 included, is used as is.
+const seedFromClock = -1
+
+// resolveSeed returns the seed a command runs with: seed itself, or one from the clock if it is negative.
+// The commands print and record the seed they used, so that a clock-seeded run can be repeated.
+func resolveSeed(seed int64) int64 {
+	if seed < 0 {
+		return time.Now().UnixNano()
+	}
+	return seed
+}
+
+// progressReporter prints how many permutations (or bootstrap samples, named by label) are done and
+// the estimated time left, at most once per interval
+type progressReporter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	label    string
+	total    int
+	done     int
+	start    time.Time
+	last     time.Time
+	interval time.Duration
+}
+
+// newProgressReporter returns a reporter writing to out, or nil (no reporting) if out is nil
+func newProgressReporter(out io.Writer, label string, total int) *progressReporter {
+	if out == nil {
+		return nil
+	}
+	now := time.Now()
+	return &progressReporter{out: out, label: label, total: total, start: now, last: now, interval: time.Second}
+}
+
+// step records one finished permutation
+func (p *progressReporter) step() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	now := time.Now()
+	if now.Sub(p.last) < p.interval && p.done < p.total {
+		return
+	}
+	p.last = now
+
+	elapsed := now.Sub(p.start)
+	eta := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+	fmt.Fprintf(p.out, "\r%s: %d/%d (%.1f%%), elapsed %s, ETA %s   ",
+		p.label, p.done, p.total, 100*float64(p.done)/float64(p.total),
+		elapsed.Round(time.Second), eta.Round(time.Second))
+}
+
+// finish ends the progress line
+func (p *progressReporter) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done > 0 {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// runPermutations calls work for permutations 0 to n-1 on the given number of goroutines
+// (all CPUs if workers < 1). Once ctx is cancelled no new permutation is started, and work should
+// return false to abandon the one it is computing. The returned slice tells which permutations
+// finished; the error is ctx.Err() if the run was cancelled before all of them did.
+// Every finished permutation is a step of progress; the caller finishes the progress line.
+func runPermutations(ctx context.Context, n, workers int, work func(ctx context.Context, k int) bool, progress *progressReporter) ([]bool, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	next := make(chan int, n)
+	for k := 0; k < n; k++ {
+		next <- k
+	}
+	close(next)
+
+	// Each permutation is finished by exactly one goroutine, so no two goroutines write the same element
+	finished := make([]bool, n)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				if ctx.Err() != nil || !work(ctx, k) {
+					return
+				}
+				finished[k] = true
+				progress.step()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, f := range finished {
+		if !f {
+			return finished, ctx.Err()
+		}
+	}
+	return finished, nil
+}
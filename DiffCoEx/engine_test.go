@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunPermutationsAll(t *testing.T) {
+	var calls int64
+	work := func(ctx context.Context, k int) bool {
+		atomic.AddInt64(&calls, 1)
+		return true
+	}
+	finished, err := runPermutations(context.Background(), 50, 4, work, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 50 {
+		t.Errorf("work called %d times, want 50", calls)
+	}
+	for k, f := range finished {
+		if !f {
+			t.Errorf("permutation %d did not finish", k)
+		}
+	}
+}
+
+func TestRunPermutationsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	work := func(ctx context.Context, k int) bool {
+		if k == 10 {
+			cancel()
+			return false
+		}
+		return ctx.Err() == nil
+	}
+	finished, err := runPermutations(ctx, 1000, 1, work, nil)
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	for k, f := range finished {
+		if f != (k < 10) {
+			t.Fatalf("permutation %d finished = %v", k, f)
+		}
+	}
+}
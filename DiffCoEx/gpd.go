@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"gonum.org/v1/gonum/stat"
+)
+
+const (
+	// gpdMinPermutations is the smallest null distribution a tail is fitted to
+	gpdMinPermutations = 100
+	// gpdStartExceedances and gpdStepExceedances set the tail sizes tried: 250, 240, ... down to 10
+	gpdStartExceedances = 250
+	gpdStepExceedances  = 10
+	// gpdBootstrap is the number of parametric bootstrap samples for the goodness of fit and the
+	// confidence interval
+	gpdBootstrap = 200
+	// gpdFitLevel is the goodness of fit p-value a tail needs to be accepted
+	gpdFitLevel = 0.05
+)
+
+// tailEstimate is a permutation p-value extrapolated from a generalized Pareto fit of the null tail
+type tailEstimate struct {
+	P     float64
+	Lower float64
+	Upper float64
+	// Exceedances is the number of null values in the fitted tail, Threshold where the tail starts
+	Exceedances int
+	Threshold   float64
+	Shape       float64
+	Scale       float64
+	// GoodnessOfFit is the Anderson-Darling p-value of the fit
+	GoodnessOfFit float64
+}
+
+// fitGPD estimates the shape xi and scale sigma of a generalized Pareto distribution from positive
+// exceedances y with the probability weighted moments of Hosking and Wallis (1987)
+func fitGPD(y []float64) (float64, float64) {
+	sorted := append([]float64{}, y...)
+	sort.Float64s(sorted)
+	n := float64(len(sorted))
+
+	// a0 = E[Y], a1 = E[Y (1 - F(Y))]
+	var a0, a1 float64
+	for i, v := range sorted {
+		a0 += v
+		a1 += v * (n - float64(i) - 1) / (n - 1)
+	}
+	a0 /= n
+	a1 /= n
+
+	// Hosking's k is -xi
+	k := a0/(a0-2*a1) - 2
+	sigma := 2 * a0 * a1 / (a0 - 2*a1)
+	return -k, sigma
+}
+
+// gpdSurvival is P(Y > y) for a generalized Pareto distribution with shape xi and scale sigma
+func gpdSurvival(y, xi, sigma float64) float64 {
+	if y <= 0 {
+		return 1
+	}
+	if math.Abs(xi) < 1e-12 {
+		return math.Exp(-y / sigma)
+	}
+	base := 1 + xi*y/sigma
+	if base <= 0 {
+		// Beyond the upper end point of a bounded (xi < 0) tail
+		return 0
+	}
+	return math.Pow(base, -1/xi)
+}
+
+// gpdRandom draws one value from a generalized Pareto distribution by inversion
+func gpdRandom(rng *rand.Rand, xi, sigma float64) float64 {
+	u := rng.Float64()
+	if math.Abs(xi) < 1e-12 {
+		return -sigma * math.Log1p(-u)
+	}
+	return sigma / xi * (math.Pow(1-u, -xi) - 1)
+}
+
+// andersonDarling returns the Anderson-Darling statistic of the sample y against a distribution
+// with the given survival function
+func andersonDarling(y []float64, survival func(float64) float64) float64 {
+	sorted := append([]float64{}, y...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+
+	cdf := make([]float64, n)
+	for i, v := range sorted {
+		// Keep the logarithms finite for values at the ends of the support
+		cdf[i] = math.Min(math.Max(1-survival(v), 1e-12), 1-1e-12)
+	}
+
+	var sum float64
+	for i := 0; i < n; i++ {
+		sum += float64(2*i+1) * (math.Log(cdf[i]) + math.Log(1-cdf[n-1-i]))
+	}
+	return -float64(n) - sum/float64(n)
+}
+
+// gpdTailPValue extrapolates the p-value of an observed statistic beyond its null distribution, following
+// Knijnenburg et al. (2009). The tail of the null distribution above a threshold is fitted with a
+// generalized Pareto distribution; starting with the 250 largest values, the tail is shrunk by 10 until
+// the Anderson-Darling test (with a parametric bootstrap p-value) accepts the fit. The p-value is
+// (tail size / permutations) * P(Y > observed - threshold), and its 95% confidence interval is the
+// percentile interval over the bootstrap fits. It returns false if no tail fits.
+func gpdTailPValue(observed float64, null []float64, rng *rand.Rand) (tailEstimate, bool) {
+	n := len(null)
+	if n < gpdMinPermutations {
+		return tailEstimate{}, false
+	}
+	sorted := append([]float64{}, null...)
+	sort.Float64s(sorted)
+
+	start := gpdStartExceedances
+	if start > n/4 {
+		start = n / 4 / gpdStepExceedances * gpdStepExceedances
+	}
+	for exceedances := start; exceedances >= gpdStepExceedances; exceedances -= gpdStepExceedances {
+		threshold := (sorted[n-exceedances-1] + sorted[n-exceedances]) / 2
+		y := make([]float64, exceedances)
+		for i := range y {
+			y[i] = sorted[n-exceedances+i] - threshold
+		}
+		if y[0] <= 0 {
+			// Ties at the threshold
+			continue
+		}
+
+		xi, sigma := fitGPD(y)
+		if !(sigma > 0) || math.IsNaN(xi) {
+			continue
+		}
+		survival := func(v float64) float64 { return gpdSurvival(v, xi, sigma) }
+		statistic := andersonDarling(y, survival)
+		tailFraction := float64(exceedances) / float64(n)
+
+		// Parametric bootstrap: the distribution of the statistic, and of the p-value, under the fit
+		atLeast := 0
+		var pBoot []float64
+		sample := make([]float64, exceedances)
+		for b := 0; b < gpdBootstrap; b++ {
+			for i := range sample {
+				sample[i] = gpdRandom(rng, xi, sigma)
+			}
+			xiB, sigmaB := fitGPD(sample)
+			if !(sigmaB > 0) || math.IsNaN(xiB) {
+				continue
+			}
+			if andersonDarling(sample, func(v float64) float64 { return gpdSurvival(v, xiB, sigmaB) }) >= statistic {
+				atLeast++
+			}
+			pBoot = append(pBoot, tailFraction*gpdSurvival(observed-threshold, xiB, sigmaB))
+		}
+		fit := float64(atLeast+1) / float64(gpdBootstrap+1)
+		if fit < gpdFitLevel || len(pBoot) == 0 {
+			continue
+		}
+
+		sort.Float64s(pBoot)
+		return tailEstimate{
+			P:             tailFraction * survival(observed-threshold),
+			Lower:         stat.Quantile(0.025, stat.Empirical, pBoot, nil),
+			Upper:         stat.Quantile(0.975, stat.Empirical, pBoot, nil),
+			Exceedances:   exceedances,
+			Threshold:     threshold,
+			Shape:         xi,
+			Scale:         sigma,
+			GoodnessOfFit: fit,
+		}, true
+	}
+	return tailEstimate{}, false
+}
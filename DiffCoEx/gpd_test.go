@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestFitGPD(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, want := range []struct{ xi, sigma float64 }{{0, 1}, {0.2, 2}, {-0.3, 0.5}} {
+		y := make([]float64, 20000)
+		for i := range y {
+			y[i] = gpdRandom(rng, want.xi, want.sigma)
+		}
+		xi, sigma := fitGPD(y)
+		if math.Abs(xi-want.xi) > 0.05 || math.Abs(sigma-want.sigma)/want.sigma > 0.05 {
+			t.Errorf("fitGPD = (%v, %v), want (%v, %v)", xi, sigma, want.xi, want.sigma)
+		}
+	}
+}
+
+func TestGPDSurvival(t *testing.T) {
+	if got := gpdSurvival(2, 0, 1); math.Abs(got-math.Exp(-2)) > 1e-12 {
+		t.Errorf("exponential survival = %v, want %v", got, math.Exp(-2))
+	}
+	// A bounded tail (xi = -0.5, sigma = 1) ends at 2
+	if got := gpdSurvival(3, -0.5, 1); got != 0 {
+		t.Errorf("survival beyond the end point = %v, want 0", got)
+	}
+}
+
+func TestGPDTailPValue(t *testing.T) {
+	// Exponential null: P(X > 12) = exp(-12), far beyond 2000 permutations
+	rng := rand.New(rand.NewSource(4))
+	null := make([]float64, 2000)
+	for i := range null {
+		null[i] = rng.ExpFloat64()
+	}
+	want := math.Exp(-12)
+
+	tail, ok := gpdTailPValue(12, null, rng)
+	if !ok {
+		t.Fatal("no tail fit")
+	}
+	if tail.P <= 0 || tail.P > 1.0/2001 || math.Abs(math.Log10(tail.P/want)) > 1.5 {
+		t.Errorf("p = %v, want about %v", tail.P, want)
+	}
+	if tail.Lower > tail.P || tail.Upper < tail.P || tail.GoodnessOfFit < gpdFitLevel {
+		t.Errorf("tail = %+v", tail)
+	}
+
+	if _, ok := gpdTailPValue(12, null[:50], rng); ok {
+		t.Error("tail fitted to 50 permutations")
+	}
+}
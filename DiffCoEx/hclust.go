@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Dendrogram holds the result of agglomerative clustering in the same layout as R's hclust object
+type Dendrogram struct {
+	// Merge[i] holds the two clusters joined at step i+1. A negative entry -k is observation k
+	// (1-based) and a positive entry k is the cluster formed at step k, exactly as in hclust$merge.
+	Merge [][2]int
+	// Height[i] is the dissimilarity at which step i+1 happened, in increasing order
+	Height []float64
+	// Order is the 0-based leaf order for plotting (hclust$order minus one)
+	Order []int
+	// Labels are the observation names used for Newick export (optional)
+	Labels []string
+	Method string
+}
+
+// condensedIndex returns the position of (i, j), i < j, in an upper triangular matrix stored row by row
+func condensedIndex(n, i, j int) int {
+	return i*n - i*(i+1)/2 + j - i - 1
+}
+
+// hierarchicalClustering performs agglomerative clustering of the dissimilarity matrix dist with
+// "average", "complete" or "single" linkage, matching R's hclust/flashClust. It uses the nearest
+// neighbour chain algorithm, which needs O(n^2) time and one copy of the upper triangle of dist.
+func hierarchicalClustering(dist mat.Symmetric, method string) (*Dendrogram, error) {
+	if method != "average" && method != "complete" && method != "single" {
+		return nil, fmt.Errorf("unknown linkage method %q (use average, complete or single)", method)
+	}
+
+	n := dist.SymmetricDim()
+	if n < 2 {
+		return nil, fmt.Errorf("need at least 2 observations to cluster, got %d", n)
+	}
+
+	// Working copy of the dissimilarities, updated as clusters merge
+	d := make([]float64, n*(n-1)/2)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d[condensedIndex(n, i, j)] = dist.At(i, j)
+		}
+	}
+	at := func(i, j int) float64 {
+		if i > j {
+			i, j = j, i
+		}
+		return d[condensedIndex(n, i, j)]
+	}
+
+	// Every cluster lives in the slot of one of its observations
+	active := make([]bool, n)
+	size := make([]int, n)
+	for i := range active {
+		active[i] = true
+		size[i] = 1
+	}
+
+	type step struct {
+		a, b   int
+		height float64
+	}
+	steps := make([]step, 0, n-1)
+	chain := make([]int, 0, n)
+
+	for len(steps) < n-1 {
+		if len(chain) == 0 {
+			for i := 0; i < n; i++ {
+				if active[i] {
+					chain = append(chain, i)
+					break
+				}
+			}
+		}
+
+		// Grow the chain until its last two clusters are reciprocal nearest neighbours
+		var a, b int
+		var minDist float64
+		for {
+			a = chain[len(chain)-1]
+			b = -1
+			minDist = math.Inf(1)
+			if len(chain) >= 2 {
+				// Prefer the previous chain element on ties so the chain cannot cycle
+				b = chain[len(chain)-2]
+				minDist = at(a, b)
+			}
+			for x := 0; x < n; x++ {
+				if active[x] && x != a {
+					if dx := at(a, x); dx < minDist {
+						minDist = dx
+						b = x
+					}
+				}
+			}
+			if len(chain) >= 2 && b == chain[len(chain)-2] {
+				break
+			}
+			chain = append(chain, b)
+		}
+		chain = chain[:len(chain)-2]
+
+		// Merge a into b using the Lance-Williams update for the chosen linkage
+		steps = append(steps, step{a: a, b: b, height: minDist})
+		for x := 0; x < n; x++ {
+			if !active[x] || x == a || x == b {
+				continue
+			}
+			da, db := at(a, x), at(b, x)
+			var updated float64
+			switch method {
+			case "average":
+				updated = (float64(size[a])*da + float64(size[b])*db) / float64(size[a]+size[b])
+			case "complete":
+				updated = math.Max(da, db)
+			case "single":
+				updated = math.Min(da, db)
+			}
+			if b < x {
+				d[condensedIndex(n, b, x)] = updated
+			} else {
+				d[condensedIndex(n, x, b)] = updated
+			}
+		}
+		size[b] += size[a]
+		active[a] = false
+	}
+
+	// The chain finds merges out of order, so sort them by height. The sort is stable and a
+	// cluster is always formed before it is merged again, so dependencies stay in order.
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].height < steps[j].height
+	})
+
+	// Replay the merges with a union-find to translate slots into hclust cluster numbers
+	parent := make([]int, n)
+	node := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+		node[i] = -(i + 1)
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	tree := &Dendrogram{
+		Merge:  make([][2]int, n-1),
+		Height: make([]float64, n-1),
+		Method: method,
+	}
+	for s, st := range steps {
+		ra, rb := find(st.a), find(st.b)
+		left, right := node[ra], node[rb]
+
+		// hclust lists observations before clusters, and otherwise the smaller number first
+		switch {
+		case left < 0 && right < 0:
+			if left < right {
+				left, right = right, left
+			}
+		case left > 0 && right < 0:
+			left, right = right, left
+		case left > 0 && right > 0:
+			if left > right {
+				left, right = right, left
+			}
+		}
+		tree.Merge[s] = [2]int{left, right}
+		tree.Height[s] = st.height
+
+		parent[ra] = rb
+		node[rb] = s + 1
+	}
+
+	tree.Order = tree.leafOrder()
+	return tree, nil
+}
+
+// leafOrder lists the leaves from left to right, as in hclust$order
+func (t *Dendrogram) leafOrder() []int {
+	order := make([]int, 0, len(t.Merge)+1)
+	stack := []int{len(t.Merge)}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top < 0 {
+			order = append(order, -top-1)
+			continue
+		}
+		// Push the right child first so that the left child is visited first
+		stack = append(stack, t.Merge[top-1][1], t.Merge[top-1][0])
+	}
+	return order
+}
+
+// NumLeaves returns the number of clustered observations
+func (t *Dendrogram) NumLeaves() int {
+	return len(t.Merge) + 1
+}
+
+// CutK cuts the tree into k groups, like R's cutree(tree, k = k). Groups are numbered from 1
+// in order of their first observation.
+func (t *Dendrogram) CutK(k int) ([]int, error) {
+	n := t.NumLeaves()
+	if k < 1 || k > n {
+		return nil, fmt.Errorf("k must be between 1 and %d, got %d", n, k)
+	}
+
+	// Apply the first n-k merges with a union-find over observations
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	member := func(entry int) int {
+		if entry < 0 {
+			return -entry - 1
+		}
+		// Any observation of a merged cluster will do; follow left children down to a leaf
+		for entry > 0 {
+			entry = t.Merge[entry-1][0]
+		}
+		return -entry - 1
+	}
+	for s := 0; s < n-k; s++ {
+		a := find(member(t.Merge[s][0]))
+		b := find(member(t.Merge[s][1]))
+		parent[a] = b
+	}
+
+	groups := make([]int, n)
+	label := make(map[int]int)
+	for i := 0; i < n; i++ {
+		root := find(i)
+		if _, ok := label[root]; !ok {
+			label[root] = len(label) + 1
+		}
+		groups[i] = label[root]
+	}
+	return groups, nil
+}
+
+// CutHeight cuts the tree at height h, like R's cutree(tree, h = h): merges above h are undone
+func (t *Dendrogram) CutHeight(h float64) []int {
+	k := t.NumLeaves()
+	for _, height := range t.Height {
+		if height <= h {
+			k--
+		}
+	}
+	groups, _ := t.CutK(k)
+	return groups
+}
+
+// Newick writes the tree in Newick format with branch lengths taken from the merge heights.
+// Leaves are named by Labels when set, otherwise by their 1-based index.
+func (t *Dendrogram) Newick() string {
+	var sb strings.Builder
+
+	var write func(entry int, parentHeight float64)
+	write = func(entry int, parentHeight float64) {
+		if entry < 0 {
+			leaf := -entry - 1
+			if leaf < len(t.Labels) {
+				sb.WriteString(newickLabel(t.Labels[leaf]))
+			} else {
+				sb.WriteString(strconv.Itoa(leaf + 1))
+			}
+			sb.WriteString(":" + strconv.FormatFloat(parentHeight, 'g', -1, 64))
+			return
+		}
+		height := t.Height[entry-1]
+		sb.WriteString("(")
+		write(t.Merge[entry-1][0], height)
+		sb.WriteString(",")
+		write(t.Merge[entry-1][1], height)
+		sb.WriteString(")")
+		if parentHeight >= 0 {
+			sb.WriteString(":" + strconv.FormatFloat(parentHeight-height, 'g', -1, 64))
+		}
+	}
+
+	write(len(t.Merge), -1)
+	sb.WriteString(";")
+	return sb.String()
+}
+
+// newickLabel quotes a leaf name if it contains characters that are special in Newick
+func newickLabel(label string) string {
+	if strings.ContainsAny(label, " \t()[]':;,") {
+		return "'" + strings.ReplaceAll(label, "'", "''") + "'"
+	}
+	return label
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// lineDistances builds the dissimilarity matrix of points on a line
+func lineDistances(points []float64) *mat.SymDense {
+	n := len(points)
+	dist := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			dist.SetSym(i, j, math.Abs(points[i]-points[j]))
+		}
+	}
+	return dist
+}
+
+func TestHierarchicalClusteringMatchesHclust(t *testing.T) {
+	// hclust(dist(c(0, 10, 11, 30, 31.5)), "average") in R
+	tree, err := hierarchicalClustering(lineDistances([]float64{0, 10, 11, 30, 31.5}), "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantMerge := [][2]int{{-2, -3}, {-4, -5}, {-1, 1}, {2, 3}}
+	wantHeight := []float64{1, 1.5, 10.5, (30 + 31.5 + 20 + 21.5 + 19 + 20.5) / 6}
+	wantOrder := []int{3, 4, 0, 1, 2}
+	for i := range wantMerge {
+		if tree.Merge[i] != wantMerge[i] {
+			t.Errorf("Merge[%d] = %v, want %v", i, tree.Merge[i], wantMerge[i])
+		}
+		if math.Abs(tree.Height[i]-wantHeight[i]) > 1e-12 {
+			t.Errorf("Height[%d] = %v, want %v", i, tree.Height[i], wantHeight[i])
+		}
+	}
+	for i := range wantOrder {
+		if tree.Order[i] != wantOrder[i] {
+			t.Fatalf("Order = %v, want %v", tree.Order, wantOrder)
+		}
+	}
+}
+
+func TestHierarchicalClusteringLinkages(t *testing.T) {
+	points := []float64{0, 1, 3, 7}
+	want := map[string][]float64{
+		"single":   {1, 2, 4},
+		"complete": {1, 3, 7},
+		"average":  {1, 2.5, (7 + 6 + 4) / 3.0},
+	}
+	for method, heights := range want {
+		tree, err := hierarchicalClustering(lineDistances(points), method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range heights {
+			if math.Abs(tree.Height[i]-heights[i]) > 1e-12 {
+				t.Errorf("%s: Height = %v, want %v", method, tree.Height, heights)
+				break
+			}
+		}
+	}
+
+	if _, err := hierarchicalClustering(lineDistances(points), "ward"); err == nil {
+		t.Errorf("expected an error for an unknown linkage")
+	}
+}
+
+func TestCutree(t *testing.T) {
+	tree, err := hierarchicalClustering(lineDistances([]float64{0, 10, 11, 30, 31.5}), "average")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := tree.CutHeight(5)
+	want := []int{1, 2, 2, 3, 3}
+	for i := range want {
+		if groups[i] != want[i] {
+			t.Fatalf("CutHeight(5) = %v, want %v", groups, want)
+		}
+	}
+
+	groups, err = tree.CutK(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []int{1, 1, 1, 2, 2}
+	for i := range want {
+		if groups[i] != want[i] {
+			t.Fatalf("CutK(2) = %v, want %v", groups, want)
+		}
+	}
+}
+
+func TestNewick(t *testing.T) {
+	tree, err := hierarchicalClustering(lineDistances([]float64{0, 1, 3}), "complete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Labels = []string{"a", "b", "gene c"}
+
+	want := "('gene c':3,(a:1,b:1):2);"
+	if got := tree.Newick(); got != want {
+		t.Errorf("Newick() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"gonum.org/v1/gonum/stat"
+)
+
+// geneMembership holds the module membership and intramodular connectivity of one gene in each condition
+type geneMembership struct {
+	Gene   string
+	Module string
+	// KME1 and KME2 are the correlations of the gene with its module eigengene, computed separately in
+	// each condition
+	KME1 float64
+	KME2 float64
+	// KWithin1 and KWithin2 are the intramodular connectivities (sum of |cor|^beta to the module's genes)
+	KWithin1 float64
+	KWithin2 float64
+	// HubRank1 and HubRank2 are the ranks of the gene by kME within its module (1 = strongest hub)
+	HubRank1 int
+	HubRank2 int
+}
+
+// DeltaKME is the change of module membership, condition 1 minus condition 2
+func (g *geneMembership) DeltaKME() float64 {
+	return g.KME1 - g.KME2
+}
+
+// conditionKME returns the correlation of every gene of a module with the module eigengene of one
+// condition (WGCNA's signedKME restricted to the module); the eigengene is computed from the condition's
+// own samples
+func conditionKME(data *labelledMatrix, genes []int) ([]float64, error) {
+	eigengene, err := moduleEigengene(data.Data, genes)
+	if err != nil {
+		return nil, err
+	}
+	kME := make([]float64, len(genes))
+	for i, gene := range genes {
+		kME[i] = stat.Correlation(getColumn(data.Data, gene), eigengene, nil)
+	}
+	return kME, nil
+}
+
+// hubRanks returns the rank of every value from the highest (1) down
+func hubRanks(values []float64) []int {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] > values[order[b]] })
+	ranks := make([]int, len(values))
+	for r, i := range order {
+		ranks[i] = r + 1
+	}
+	return ranks
+}
+
+// moduleMemberships computes kME and intramodular connectivity in both conditions for every gene of the
+// modules (or coXpress groups) with at least minSize genes, grey excluded. The genes are returned module
+// by module, in alphabetical order of the modules, ranked by kME in condition 1.
+func moduleMemberships(datC1, datC2 *labelledMatrix, colorh1C1C2 map[string]string, beta float64, minSize int) ([]geneMembership, []string, error) {
+	labels := colorsForGenes(datC1.GeneIDs, colorh1C1C2)
+	all, columns := moduleColumns(labels)
+	var modules []string
+	var members [][]int
+	for _, module := range all {
+		if len(columns[module]) >= minSize {
+			modules = append(modules, module)
+			members = append(members, columns[module])
+		}
+	}
+
+	sub1, subMembers := moduleSubmatrix(datC1, colorh1C1C2, modules)
+	sub2, _ := moduleSubmatrix(datC2, colorh1C1C2, modules)
+	within1, _ := connectivity(spearmanMatrix(sub1), subMembers, beta)
+	within2, _ := connectivity(spearmanMatrix(sub2), subMembers, beta)
+
+	var genes []geneMembership
+	for m, module := range modules {
+		kME1, err := conditionKME(datC1, members[m])
+		if err != nil {
+			return nil, nil, fmt.Errorf("module %s, condition 1: %v", module, err)
+		}
+		kME2, err := conditionKME(datC2, members[m])
+		if err != nil {
+			return nil, nil, fmt.Errorf("module %s, condition 2: %v", module, err)
+		}
+		ranks1, ranks2 := hubRanks(kME1), hubRanks(kME2)
+
+		moduleGenes := make([]geneMembership, len(members[m]))
+		for i, gene := range members[m] {
+			// moduleSubmatrix keeps the genes in data order, as moduleColumns lists them
+			position := subMembers[m][i]
+			moduleGenes[i] = geneMembership{
+				Gene:     datC1.GeneIDs[gene],
+				Module:   module,
+				KME1:     kME1[i],
+				KME2:     kME2[i],
+				KWithin1: within1[position],
+				KWithin2: within2[position],
+				HubRank1: ranks1[i],
+				HubRank2: ranks2[i],
+			}
+		}
+		sort.SliceStable(moduleGenes, func(a, b int) bool { return moduleGenes[a].HubRank1 < moduleGenes[b].HubRank1 })
+		genes = append(genes, moduleGenes...)
+	}
+	return genes, modules, nil
+}
+
+// topHubs returns the genes of one module with a hub rank up to top, strongest first
+func topHubs(genes []geneMembership, rank func(g geneMembership) int, top int) []string {
+	hubs := make([]string, top)
+	for _, g := range genes {
+		if r := rank(g); r <= top {
+			hubs[r-1] = g.Gene
+		}
+	}
+	if len(genes) < top {
+		hubs = hubs[:len(genes)]
+	}
+	return hubs
+}
+
+// saveModuleHubs writes the genes of every module ranked by kME in condition 1, with both conditions'
+// kME, intramodular connectivity and hub rank
+func saveModuleHubs(genes []geneMembership, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"module", "gene", "kME.c1", "kME.c2", "dkME", "kWithin.c1", "kWithin.c2",
+		"hub.rank.c1", "hub.rank.c2"}); err != nil {
+		return err
+	}
+	for _, g := range genes {
+		row := []string{
+			g.Module, g.Gene,
+			formatNA(g.KME1), formatNA(g.KME2), formatNA(g.DeltaKME()),
+			formatNA(g.KWithin1), formatNA(g.KWithin2),
+			strconv.Itoa(g.HubRank1), strconv.Itoa(g.HubRank2),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveKMEChanges writes the genes of all modules ranked by how much their kME changes between the conditions
+func saveKMEChanges(genes []geneMembership, filename string) error {
+	ranked := append([]geneMembership{}, genes...)
+	sort.SliceStable(ranked, func(a, b int) bool {
+		return math.Abs(ranked[a].DeltaKME()) > math.Abs(ranked[b].DeltaKME())
+	})
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"rank", "gene", "module", "kME.c1", "kME.c2", "dkME"}); err != nil {
+		return err
+	}
+	for r, g := range ranked {
+		row := []string{strconv.Itoa(r + 1), g.Gene, g.Module, formatNA(g.KME1), formatNA(g.KME2), formatNA(g.DeltaKME())}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHubs ranks the hub genes of every module in each condition by module membership, from a DiffCoEx
+// module file or the groups written by coxpress
+func runHubs(args []string) error {
+	fs := flag.NewFlagSet("hubs", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	modulesFile := fs.String("modules", "", "gene module file (\"gene color\" per line), e.g. module_colors.txt or coxpress_groups.txt")
+	beta := fs.Float64("beta", defaultBeta, "soft thresholding power of the adjacency |cor|^beta for the intramodular connectivity")
+	minSize := fs.Int("minsize", 3, "smallest module (or coXpress group) reported")
+	top := fs.Int("top", 3, "hubs printed per module and condition")
+	hubsOut := fs.String("out", "module_hubs.csv", "output hub ranking of every module")
+	changesOut := fs.String("changes", "kme_changes.csv", "output genes ranked by their change of kME")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" || *modulesFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-c1, -c2 and -modules are required")
+	}
+	if *top < 0 || *minSize < 1 {
+		return fmt.Errorf("-top must be at least 0 and -minsize at least 1")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	colorh1C1C2, err := genecolor.ReadFile(*modulesFile)
+	if err != nil {
+		return err
+	}
+
+	missing, _ := moduleMembership(dataC1.GeneIDs, colorh1C1C2)
+	reportGenes(fmt.Sprintf("genes in %s missing from the expression data", *modulesFile), missing)
+
+	datC1 := &labelledMatrix{Data: samplesByGenes(dataC1.Data), GeneIDs: dataC1.GeneIDs}
+	datC2 := &labelledMatrix{Data: samplesByGenes(dataC2.Data), GeneIDs: dataC2.GeneIDs}
+	genes, modules, err := moduleMemberships(datC1, datC2, colorh1C1C2, *beta, *minSize)
+	if err != nil {
+		return err
+	}
+	if len(modules) == 0 {
+		return fmt.Errorf("no modules besides %s with at least %d genes", greyLabel, *minSize)
+	}
+
+	// Print the strongest hubs of every module in each condition
+	start := 0
+	for _, module := range modules {
+		end := start
+		for end < len(genes) && genes[end].Module == module {
+			end++
+		}
+		moduleGenes := genes[start:end]
+		fmt.Printf("%s (%d genes): hubs in C1 %s; in C2 %s\n", module, len(moduleGenes),
+			strings.Join(topHubs(moduleGenes, func(g geneMembership) int { return g.HubRank1 }, *top), ", "),
+			strings.Join(topHubs(moduleGenes, func(g geneMembership) int { return g.HubRank2 }, *top), ", "))
+		start = end
+	}
+
+	if err := saveModuleHubs(genes, *hubsOut); err != nil {
+		return err
+	}
+	if err := saveKMEChanges(genes, *changesOut); err != nil {
+		return err
+	}
+	fmt.Printf("Files saved: %s, %s\n", *hubsOut, *changesOut)
+	return nil
+}
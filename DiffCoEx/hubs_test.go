@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestHubRanks(t *testing.T) {
+	ranks := hubRanks([]float64{0.2, 0.9, -0.5, 0.4})
+	want := []int{3, 1, 4, 2}
+	for i := range want {
+		if ranks[i] != want[i] {
+			t.Fatalf("hubRanks = %v, want %v", ranks, want)
+		}
+	}
+}
+
+func TestModuleMembershipsFindsLostMember(t *testing.T) {
+	// Genes 0-4 follow one factor in both conditions except gene 0, which only does in condition 1;
+	// genes 5 and 6 form a group too small to report
+	rng := rand.New(rand.NewSource(21))
+	geneIDs := make([]string, 8)
+	colorh1C1C2 := map[string]string{"g5": "2", "g6": "2"}
+	for j := range geneIDs {
+		geneIDs[j] = "g" + strconv.Itoa(j)
+		if j < 5 {
+			colorh1C1C2[geneIDs[j]] = "1"
+		}
+	}
+	condition := func(rewired bool) *labelledMatrix {
+		data := mat.NewDense(25, len(geneIDs), nil)
+		for i := 0; i < 25; i++ {
+			factor := rng.NormFloat64()
+			for j := range geneIDs {
+				v := rng.NormFloat64()
+				if j < 5 && !(j == 0 && rewired) {
+					v = factor + 0.4*v
+				}
+				data.Set(i, j, v)
+			}
+		}
+		return &labelledMatrix{Data: data, GeneIDs: geneIDs}
+	}
+	datC1, datC2 := condition(false), condition(true)
+
+	genes, modules, err := moduleMemberships(datC1, datC2, colorh1C1C2, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != 1 || modules[0] != "1" || len(genes) != 5 {
+		t.Fatalf("modules = %v with %d genes, want group 1 with 5 genes", modules, len(genes))
+	}
+
+	var lost geneMembership
+	for r, g := range genes {
+		if g.HubRank1 != r+1 {
+			t.Errorf("gene %s at position %d has condition 1 hub rank %d", g.Gene, r+1, g.HubRank1)
+		}
+		if math.Abs(g.DeltaKME()) > math.Abs(lost.DeltaKME()) || lost.Gene == "" {
+			lost = g
+		}
+	}
+	if lost.Gene != "g0" || lost.KME1 < 0.8 || math.Abs(lost.KME2) > 0.5 || lost.HubRank2 != 5 {
+		t.Errorf("largest kME change = %+v, want g0 leaving the module in condition 2", lost)
+	}
+	if !(lost.KWithin1 > lost.KWithin2) {
+		t.Errorf("g0 intramodular connectivity %v in C1, %v in C2, want a loss", lost.KWithin1, lost.KWithin2)
+	}
+}
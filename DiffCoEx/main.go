@@ -1,25 +1,101 @@
 package main
 
-// ... existing imports ...
 import (
-	// Add this import
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
 )
 
-// ... existing functions ...
+func usage() {
+	fmt.Println("Usage: ./preprocess <dataset_type> <file_path>")
+	fmt.Println("dataset_type: 'rat' or 'golub'")
+	fmt.Println("   or: ./preprocess <command> [flags]")
+	fmt.Println("command: 'diffcoex', 'adjacency', 'cluster', 'merge', 'colors', 'pickpower', 'coxpress', 'permute', 'bootstrap', 'connectivity' or 'hubs'")
+	fmt.Println("Run a command with -h to see its flags")
+}
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: ./preprocess <dataset_type> <file_path>")
-		fmt.Println("dataset_type: 'rat' or 'golub'")
+	if len(os.Args) < 2 {
+		usage()
 		os.Exit(1)
 	}
 
-	datasetType := os.Args[1]
-	filePath := os.Args[2]
+	switch os.Args[1] {
+	case "rat", "golub":
+		if len(os.Args) != 3 {
+			usage()
+			os.Exit(1)
+		}
+		preprocess(os.Args[1], os.Args[2])
+
+	case "diffcoex":
+		if err := runDiffCoEx(os.Args[2:]); err != nil {
+			log.Fatalf("Error running DiffCoEx: %v", err)
+		}
+
+	case "adjacency":
+		if err := runAdjacency(os.Args[2:]); err != nil {
+			log.Fatalf("Error building adjacency matrix: %v", err)
+		}
+
+	case "cluster":
+		if err := runCluster(os.Args[2:]); err != nil {
+			log.Fatalf("Error clustering: %v", err)
+		}
+
+	case "merge":
+		if err := runMerge(os.Args[2:]); err != nil {
+			log.Fatalf("Error merging modules: %v", err)
+		}
+
+	case "colors":
+		if err := runColors(os.Args[2:]); err != nil {
+			log.Fatalf("Error converting module labels: %v", err)
+		}
+
+	case "pickpower":
+		if err := runPickPower(os.Args[2:]); err != nil {
+			log.Fatalf("Error picking soft threshold: %v", err)
+		}
+
+	case "coxpress":
+		if err := runCoXpress(os.Args[2:]); err != nil {
+			log.Fatalf("Error running coXpress: %v", err)
+		}
+
+	case "permute":
+		if err := runPermute(os.Args[2:]); err != nil {
+			log.Fatalf("Error running permutation test: %v", err)
+		}
+
+	case "bootstrap":
+		if err := runBootstrap(os.Args[2:]); err != nil {
+			log.Fatalf("Error running bootstrap: %v", err)
+		}
+
+	case "connectivity":
+		if err := runConnectivity(os.Args[2:]); err != nil {
+			log.Fatalf("Error running connectivity test: %v", err)
+		}
+
+	case "hubs":
+		if err := runHubs(os.Args[2:]); err != nil {
+			log.Fatalf("Error ranking hub genes: %v", err)
+		}
+
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
 
+func preprocess(datasetType, filePath string) {
 	switch datasetType {
 	case "rat":
 		// Process rat data (GDS2901.soft)
@@ -73,8 +149,296 @@ func main() {
 			log.Fatalf("Error saving AML samples data: %v", err)
 		}
 		fmt.Println("Golub data processing complete! Files saved: all_samples.csv, aml_samples.csv")
+	}
+}
+
+// runAdjacency builds the DiffCoEx differential adjacency matrix from two condition files,
+// replacing the WGCNA-based AdjMatC1/AdjMatC2 step of clustering.R
+func runAdjacency(args []string) error {
+	fs := flag.NewFlagSet("adjacency", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	beta := fs.Float64("beta", defaultBeta, "soft thresholding power")
+	tom := fs.Bool("tom", false, "write the topological overlap dissimilarity (TOMdist) of the differential matrix instead")
+	signed := fs.Bool("signed", false, "use the signed topological overlap (only with -tom)")
+	threads := fs.Int("threads", 0, "goroutines used for the topological overlap (0 = all CPUs)")
+	out := fs.String("out", "differential_adjacency.csv", "output file")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" {
+		fs.Usage()
+		return fmt.Errorf("both -c1 and -c2 are required")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+
+	adjC1 := conditionAdjacency(samplesByGenes(dataC1.Data))
+	adjC2 := conditionAdjacency(samplesByGenes(dataC2.Data))
+	diff := differentialAdjacency(adjC1, adjC2, *beta)
+
+	if *tom {
+		dissTOM := tomDist(diff, *signed, *threads)
+		if err := saveMatrixCSV(dissTOM, dataC1.GeneIDs, *out); err != nil {
+			return err
+		}
+		fmt.Printf("TOM dissimilarity of the differential matrix (beta = %g) saved to %s\n", *beta, *out)
+		return nil
+	}
+
+	if err := saveMatrixCSV(diff, dataC1.GeneIDs, *out); err != nil {
+		return err
+	}
+	fmt.Printf("Differential adjacency matrix (beta = %g) saved to %s\n", *beta, *out)
+	return nil
+}
+
+// runCluster performs hierarchical clustering of a dissimilarity matrix written by the adjacency command,
+// replacing flashClust/hclust, and optionally cuts the tree like cutree
+func runCluster(args []string) error {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	in := fs.String("in", "", "dissimilarity matrix (output of adjacency -tom)")
+	method := fs.String("method", "average", "linkage: average, complete or single")
+	newick := fs.String("newick", "", "write the dendrogram in Newick format to this file")
+	cutHeight := fs.Float64("h", -1, "cut the tree at this height (like cutree(h=...))")
+	cutK := fs.Int("k", 0, "cut the tree into this many groups (like cutree(k=...))")
+	dynamic := fs.Bool("dynamic", false, "use the hybrid dynamic tree cut (cutreeDynamic) instead of a static cut")
+	defaults := diffCoExCutOptions()
+	dynamicHeight := fs.Float64("cutheight", defaults.CutHeight, "maximum joining height for -dynamic (0 = R default)")
+	minSize := fs.Int("minsize", defaults.MinClusterSize, "minimum cluster size for -dynamic")
+	deepSplit := fs.Int("deepsplit", defaults.DeepSplit, "deepSplit for -dynamic, 0 to 4 (R's TRUE is 3)")
+	pamDendro := fs.Bool("pamdendro", defaults.PamRespectsDendro, "PAM stage only assigns genes within their own branch (pamRespectsDendro)")
+	noPam := fs.Bool("nopam", false, "skip the PAM stage of -dynamic")
+	colors := fs.Bool("colors", false, "write WGCNA color names instead of group numbers (0 becomes grey)")
+	out := fs.String("out", "clusters.txt", "output file for the gene to group assignment")
+	fs.Parse(args)
+
+	if *in == "" {
+		fs.Usage()
+		return fmt.Errorf("-in is required")
+	}
+	if (*cutHeight >= 0 && *cutK > 0) || (*dynamic && (*cutHeight >= 0 || *cutK > 0)) {
+		return fmt.Errorf("use only one of -h, -k and -dynamic")
+	}
+
+	dist, geneIDs, err := readMatrixCSV(*in)
+	if err != nil {
+		return err
+	}
+	tree, err := hierarchicalClustering(dist, *method)
+	if err != nil {
+		return err
+	}
+	tree.Labels = geneIDs
 
+	if *newick != "" {
+		if err := os.WriteFile(*newick, []byte(tree.Newick()+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Dendrogram saved to %s\n", *newick)
+	}
+
+	var groups []int
+	switch {
+	case *dynamic:
+		opts := dynamicCutOptions{
+			CutHeight:         *dynamicHeight,
+			MinClusterSize:    *minSize,
+			DeepSplit:         *deepSplit,
+			PamStage:          !*noPam,
+			PamRespectsDendro: *pamDendro,
+		}
+		groups, err = cutreeHybrid(tree, dist, opts)
+		if err != nil {
+			return err
+		}
+	case *cutK > 0:
+		groups, err = tree.CutK(*cutK)
+		if err != nil {
+			return err
+		}
+	case *cutHeight >= 0:
+		groups = tree.CutHeight(*cutHeight)
 	default:
-		log.Fatalf("Unknown dataset type: %s. Use 'rat' or 'golub'", datasetType)
+		return nil
+	}
+
+	labels := make([]string, len(groups))
+	if *colors {
+		labels = labels2colors(groups)
+	} else {
+		for i, group := range groups {
+			labels[i] = strconv.Itoa(group)
+		}
+	}
+	if err := genecolor.WriteFile(*out, geneIDs, labels); err != nil {
+		return err
+	}
+	fmt.Printf("Gene groups saved to %s\n", *out)
+	return nil
+}
+
+// runMerge merges modules whose eigengenes are close, like mergeCloseModules(rbind(datC1, datC2), colors, cutHeight)
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	modules := fs.String("modules", "", "gene module file (\"gene color\" per line)")
+	cutHeight := fs.Float64("cutheight", 0.2, "merge modules whose eigengene dissimilarity 1-cor is below this height")
+	out := fs.String("out", "merged_modules.txt", "output gene module file")
+	eigengenesOut := fs.String("eigengenes", "eigengenes.csv", "output file for the merged module eigengenes")
+	logOut := fs.String("log", "merge_log.txt", "output file for the merge log")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" || *modules == "" {
+		fs.Usage()
+		return fmt.Errorf("-c1, -c2 and -modules are required")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	geneColorMap, err := genecolor.ReadFile(*modules)
+	if err != nil {
+		return err
+	}
+	colors := colorsForGenes(dataC1.GeneIDs, geneColorMap)
+
+	stacked := stackConditions(samplesByGenes(dataC1.Data), samplesByGenes(dataC2.Data))
+	result, err := mergeCloseModules(stacked, colors, *cutHeight)
+	if err != nil {
+		return err
+	}
+
+	if err := genecolor.WriteFile(*out, dataC1.GeneIDs, result.Labels); err != nil {
+		return err
+	}
+	if err := saveEigengenes(result, dataC1.Data, *eigengenesOut); err != nil {
+		return err
+	}
+	if err := saveMergeLog(result.Log, *logOut); err != nil {
+		return err
+	}
+	fmt.Printf("%d merges, %d modules left. Files saved: %s, %s, %s\n", len(result.Log), len(result.Modules), *out, *eigengenesOut, *logOut)
+	return nil
+}
+
+// runColors converts a module file between numeric cluster IDs (as from coXpress cutree or the cluster command)
+// and WGCNA color names, so that Go and R output use the same module names
+func runColors(args []string) error {
+	fs := flag.NewFlagSet("colors", flag.ExitOnError)
+	in := fs.String("in", "", "module file (\"gene label\" per line, or a Gene,Cluster CSV)")
+	toNumbers := fs.Bool("numeric", false, "convert colors back to numeric cluster IDs")
+	out := fs.String("out", "module_colors.txt", "output module file")
+	fs.Parse(args)
+
+	if *in == "" {
+		fs.Usage()
+		return fmt.Errorf("-in is required")
+	}
+
+	geneLabelMap, err := genecolor.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	geneIDs := make([]string, 0, len(geneLabelMap))
+	for gene := range geneLabelMap {
+		geneIDs = append(geneIDs, gene)
+	}
+	sort.Strings(geneIDs)
+	labels := make([]string, len(geneIDs))
+	for i, gene := range geneIDs {
+		labels[i] = geneLabelMap[gene]
+	}
+
+	var converted []string
+	if *toNumbers {
+		numbers, err := colors2labels(labels)
+		if err != nil {
+			return err
+		}
+		converted = make([]string, len(numbers))
+		for i, n := range numbers {
+			converted[i] = strconv.Itoa(n)
+		}
+	} else {
+		numbers, err := numericLabels(labels)
+		if err != nil {
+			return err
+		}
+		converted = labels2colors(numbers)
+	}
+
+	if err := genecolor.WriteFile(*out, geneIDs, converted); err != nil {
+		return err
+	}
+	fmt.Printf("Converted module labels saved to %s\n", *out)
+	return nil
+}
+
+// runPickPower reports the scale-free topology fit for a range of soft thresholding powers, like WGCNA's
+// pickSoftThreshold, for each condition and for the differential matrix, and recommends a power for each
+func runPickPower(args []string) error {
+	fs := flag.NewFlagSet("pickpower", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	powerList := fs.String("powers", "", "comma separated powers to try (default 1-10,12,14,...,20)")
+	target := fs.Float64("rsq", 0.85, "scale-free topology R^2 a recommended power must reach")
+	out := fs.String("out", "soft_threshold.txt", "output table")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" {
+		fs.Usage()
+		return fmt.Errorf("both -c1 and -c2 are required")
+	}
+
+	powers := defaultPowers
+	if *powerList != "" {
+		powers = nil
+		for _, field := range strings.Split(*powerList, ",") {
+			power, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil || power <= 0 {
+				return fmt.Errorf("invalid power %q", field)
+			}
+			powers = append(powers, power)
+		}
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	corC1 := spearmanMatrix(samplesByGenes(dataC1.Data))
+	corC2 := spearmanMatrix(samplesByGenes(dataC2.Data))
+
+	networks := []string{"C1", "C2", "differential"}
+	fits := [][]softThresholdFit{
+		conditionSoftThreshold(corC1, powers),
+		conditionSoftThreshold(corC2, powers),
+		differentialSoftThreshold(adjacencyMatrix(corC1), adjacencyMatrix(corC2), powers),
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, "network\tPower\tSFT.R.sq\tslope\tmean.k.\tmedian.k.\tmax.k.")
+	for n, network := range networks {
+		for _, fit := range fits[n] {
+			fmt.Fprintf(file, "%s\t%g\t%g\t%g\t%g\t%g\t%g\n", network, fit.Power, fit.RSquared, fit.Slope, fit.MeanK, fit.MedianK, fit.MaxK)
+		}
+
+		if power, ok := recommendedPower(fits[n], *target); ok {
+			fmt.Printf("%s: lowest power with scale-free R^2 >= %g is %g\n", network, *target, power)
+		} else {
+			fmt.Printf("%s: no power reaches scale-free R^2 >= %g\n", network, *target)
+		}
 	}
+	fmt.Printf("Soft threshold table saved to %s\n", *out)
+	return nil
 }
@@ -1,90 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
 	"math"
 	"math/rand"
-	"os"
 	"sort"
-	"strings"
-	"time"
 
 	"gonum.org/v1/gonum/mat"
 )
 
-// Helper function to calculate Spearman correlation
-func spearmanCorrelation(x, y []float64) float64 {
-	if len(x) != len(y) {
-		panic("Input slices must have equal length")
-	}
-
-	n := len(x)
-
-	// Create rank pairs
-	type pair struct {
-		value float64
-		rank  float64
-	}
-
-	// Calculate ranks for x
-	xPairs := make([]pair, n)
-	for i, v := range x {
-		xPairs[i] = pair{v, float64(i)}
-	}
-	sort.Slice(xPairs, func(i, j int) bool {
-		return xPairs[i].value < xPairs[j].value
-	})
-	for i := range xPairs {
-		xPairs[i].rank = float64(i + 1)
-	}
-
-	// Calculate ranks for y
-	yPairs := make([]pair, n)
-	for i, v := range y {
-		yPairs[i] = pair{v, float64(i)}
-	}
-	sort.Slice(yPairs, func(i, j int) bool {
-		return yPairs[i].value < yPairs[j].value
-	})
-	for i := range yPairs {
-		yPairs[i].rank = float64(i + 1)
-	}
-
-	// Restore original order and calculate correlation
-	xRanks := make([]float64, n)
-	yRanks := make([]float64, n)
-	for i := range xPairs {
-		idx := int(xPairs[i].rank) - 1
-		xRanks[idx] = float64(i + 1)
-	}
-	for i := range yPairs {
-		idx := int(yPairs[i].rank) - 1
-		yRanks[idx] = float64(i + 1)
-	}
-
-	// Calculate mean of ranks
-	var sumX, sumY float64
-	for i := 0; i < n; i++ {
-		sumX += xRanks[i]
-		sumY += yRanks[i]
-	}
-	meanX := sumX / float64(n)
-	meanY := sumY / float64(n)
-
-	// Calculate correlation
-	var numerator, denomX, denomY float64
-	for i := 0; i < n; i++ {
-		dx := xRanks[i] - meanX
-		dy := yRanks[i] - meanY
-		numerator += dx * dy
-		denomX += dx * dx
-		denomY += dy * dy
-	}
-
-	return numerator / math.Sqrt(denomX*denomY)
-}
-
 // Helper function to convert mat.Dense column to []float64
 func getColumn(m *mat.Dense, col int) []float64 {
 	rows, _ := m.Dims()
@@ -93,98 +16,188 @@ func getColumn(m *mat.Dense, col int) []float64 {
 	return column
 }
 
-// Helper function to get columns matching a specific color
-func getColumnsForColor(data *mat.Dense, colorh1C1C2 map[string]string, color string) [][]float64 {
-	rows, cols := data.Dims()
-	var columns [][]float64
+// labelledMatrix is an expression matrix (samples x genes) that carries the gene ID of every column,
+// so module membership can be resolved by name
+type labelledMatrix struct {
+	Data    *mat.Dense
+	GeneIDs []string
+}
+
+// moduleMembership compares the genes of a module file with the genes of the data. It returns the genes
+// of the module file that are missing from the data and the genes of the data that have no module,
+// both in sorted order.
+func moduleMembership(geneIDs []string, colorh1C1C2 map[string]string) ([]string, []string) {
+	inData := make(map[string]bool, len(geneIDs))
+	var unassigned []string
+	for _, gene := range geneIDs {
+		inData[gene] = true
+		if _, exists := colorh1C1C2[gene]; !exists {
+			unassigned = append(unassigned, gene)
+		}
+	}
 
-	for i := 0; i < cols; i++ {
-		if val, exists := colorh1C1C2[fmt.Sprintf("gene%d", i+1)]; exists && val == color {
-			column := make([]float64, rows)
-			mat.Col(column, i, data)
-			columns = append(columns, column)
+	var missing []string
+	for gene := range colorh1C1C2 {
+		if !inData[gene] {
+			missing = append(missing, gene)
 		}
 	}
-	return columns
+	sort.Strings(missing)
+	sort.Strings(unassigned)
+	return missing, unassigned
 }
 
-// dispersionModule2Module calculates the dispersion value between two modules
-func dispersionModule2Module(c1, c2 string, datC1, datC2 *mat.Dense, colorh1C1C2 map[string]string) float64 {
-	if c1 == c2 {
-		columnsC1 := getColumnsForColor(datC1, colorh1C1C2, c1)
-		columnsC2 := getColumnsForColor(datC2, colorh1C1C2, c1)
+// moduleSubmatrix keeps the columns of data that belong to one of the modules and returns, for every
+// module, the positions of its genes among the kept columns
+func moduleSubmatrix(data *labelledMatrix, colorh1C1C2 map[string]string, modules []string) (*mat.Dense, [][]int) {
+	position := make(map[string]int, len(modules))
+	for m, module := range modules {
+		position[module] = m
+	}
 
-		n := len(columnsC1)
-		if n == 0 {
-			return 0.0
+	var columns []int
+	members := make([][]int, len(modules))
+	for i, gene := range data.GeneIDs {
+		if m, ok := position[colorh1C1C2[gene]]; ok {
+			members[m] = append(members[m], len(columns))
+			columns = append(columns, i)
 		}
+	}
+
+	rows, _ := data.Data.Dims()
+	sub := mat.NewDense(rows, len(columns), nil)
+	for j, col := range columns {
+		sub.SetCol(j, getColumn(data.Data, col))
+	}
+	return sub, members
+}
 
-		var sumDifCorSquared float64
-		for i := 0; i < n; i++ {
-			for j := i + 1; j < n; j++ {
-				corC1 := spearmanCorrelation(columnsC1[i], columnsC1[j])
-				corC2 := spearmanCorrelation(columnsC2[i], columnsC2[j])
-				difCor := corC1 - corC2
-				sumDifCorSquared += difCor * difCor
+// moduleDispersions gives the dispersion (dispersionModule2Module in 02601proj.R) of every pair of modules,
+// computed from the correlation matrices of the two conditions. members[m] holds the rows (and columns)
+// of module m's genes.
+func moduleDispersions(corC1, corC2 mat.Symmetric, members [][]int) [][]float64 {
+	dispersion := make([][]float64, len(members))
+	for a := range members {
+		dispersion[a] = make([]float64, len(members))
+	}
+
+	for a, genesA := range members {
+		for b := a; b < len(members); b++ {
+			genesB := members[b]
+			if len(genesA) == 0 || len(genesB) == 0 {
+				continue
 			}
-		}
 
-		denominator := float64(n*n-n) / 2.0
-		return math.Sqrt((1.0 / denominator) * (sumDifCorSquared / 2.0))
+			var sumDifCorSquared float64
+			if a == b {
+				n := len(genesA)
+				for i := 0; i < n; i++ {
+					for j := i + 1; j < n; j++ {
+						difCor := corC1.At(genesA[i], genesA[j]) - corC2.At(genesA[i], genesA[j])
+						sumDifCorSquared += difCor * difCor
+					}
+				}
+				// R sums the squared differences over the full matrix and halves that, which is the sum over i < j
+				denominator := float64(n*n-n) / 2.0
+				dispersion[a][a] = math.Sqrt((1.0 / denominator) * sumDifCorSquared)
+				continue
+			}
 
-	} else {
-		columnsC1_1 := getColumnsForColor(datC1, colorh1C1C2, c1)
-		columnsC1_2 := getColumnsForColor(datC1, colorh1C1C2, c2)
+			for _, i := range genesA {
+				for _, j := range genesB {
+					difCor := corC1.At(i, j) - corC2.At(i, j)
+					sumDifCorSquared += difCor * difCor
+				}
+			}
+			dispersion[a][b] = math.Sqrt((1.0 / float64(len(genesA)*len(genesB))) * sumDifCorSquared)
+			dispersion[b][a] = dispersion[a][b]
+		}
+	}
+	return dispersion
+}
 
-		columnsC2_1 := getColumnsForColor(datC2, colorh1C1C2, c1)
-		columnsC2_2 := getColumnsForColor(datC2, colorh1C1C2, c2)
+// splitRows returns the rows of d listed in permutation and the remaining rows, like d[permutation,]
+// and d[-permutation,] in R
+func splitRows(d *mat.Dense, permutation []int) (*mat.Dense, *mat.Dense) {
+	rows, cols := d.Dims()
+	used := make([]bool, rows)
+	d1 := mat.NewDense(len(permutation), cols, nil)
+	for i, idx := range permutation {
+		d1.SetRow(i, d.RawRowView(idx))
+		used[idx] = true
+	}
 
-		n1 := len(columnsC1_1)
-		n2 := len(columnsC1_2)
-		if n1 == 0 || n2 == 0 {
-			return 0.0
+	d2 := mat.NewDense(rows-len(permutation), cols, nil)
+	j := 0
+	for i := 0; i < rows; i++ {
+		if !used[i] {
+			d2.SetRow(j, d.RawRowView(i))
+			j++
 		}
+	}
+	return d1, d2
+}
 
-		var sumDifCorSquared float64
-		for i := 0; i < n1; i++ {
-			for j := 0; j < n2; j++ {
-				corC1 := spearmanCorrelation(columnsC1_1[i], columnsC1_2[j])
-				corC2 := spearmanCorrelation(columnsC2_1[i], columnsC2_2[j])
-				difCor := corC1 - corC2
-				sumDifCorSquared += difCor * difCor
+// permutedDispersions computes the dispersion of every pair of modules on one permutation of the scaled,
+// combined module genes. The Spearman correlations of each permuted condition are computed once and
+// shared by all pairs. If active is not nil, only the genes of modules marked active are correlated and
+// pairs involving other modules are left at 0.
+func permutedDispersions(permutation []int, d *mat.Dense, members [][]int, active []bool) [][]float64 {
+	if active != nil {
+		var columns []int
+		activeMembers := make([][]int, len(members))
+		for m, genes := range members {
+			if !active[m] {
+				continue
+			}
+			for _, gene := range genes {
+				activeMembers[m] = append(activeMembers[m], len(columns))
+				columns = append(columns, gene)
 			}
 		}
-
-		return math.Sqrt((1.0 / float64(n1*n2)) * sumDifCorSquared)
+		rows, _ := d.Dims()
+		sub := mat.NewDense(rows, len(columns), nil)
+		for j, col := range columns {
+			sub.SetCol(j, getColumn(d, col))
+		}
+		d, members = sub, activeMembers
 	}
-}
 
-// generatePermutations creates a set of permuted indices
-func generatePermutations(datC1, datC2 *mat.Dense, numPermutations int) [][]int {
-	rows1, _ := datC1.Dims()
-	rows2, _ := datC2.Dims()
-	totalSamples := rows1 + rows2
-	sampleSize := rows1
+	d1, d2 := splitRows(d, permutation)
+	return moduleDispersions(spearmanMatrix(d1), spearmanMatrix(d2), members)
+}
 
-	permutations := make([][]int, numPermutations)
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+// splitmix64 is the output function of the SplitMix64 generator. Successive values of x give well
+// separated 64 bit seeds.
+func splitmix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
 
-	for i := 0; i < numPermutations; i++ {
-		indices := make([]int, totalSamples)
-		for j := range indices {
-			indices[j] = j
-		}
+// permutationRand returns the random stream of permutation k, the k-th SplitMix64 value after seed.
+// Every permutation has its own stream, so the permutations do not depend on how they are split
+// over goroutines.
+func permutationRand(seed int64, k int) *rand.Rand {
+	state := uint64(seed) + uint64(k+1)*0x9e3779b97f4a7c15
+	return rand.New(rand.NewSource(int64(splitmix64(state))))
+}
 
-		for j := totalSamples - 1; j > 0; j-- {
-			k := r.Intn(j + 1)
-			indices[j], indices[k] = indices[k], indices[j]
-		}
+// randomPermutation draws permutation k of the given seed: sampleSize indices out of totalSamples,
+// like R's sample(1:totalSamples, sampleSize)
+func randomPermutation(seed int64, k, totalSamples, sampleSize int) []int {
+	r := permutationRand(seed, k)
+	indices := make([]int, totalSamples)
+	for j := range indices {
+		indices[j] = j
+	}
 
-		permutations[i] = make([]int, sampleSize)
-		copy(permutations[i], indices[:sampleSize])
+	for j := totalSamples - 1; j > 0; j-- {
+		l := r.Intn(j + 1)
+		indices[j], indices[l] = indices[l], indices[j]
 	}
 
-	return permutations
+	return indices[:sampleSize:sampleSize]
 }
 
 // scaleData scales the input data to have mean 0 and variance 1
@@ -227,7 +240,8 @@ func scaleData(data *mat.Dense) *mat.Dense {
 	return scaledData
 }
 
-// combineAndScaleData combines and scales datC1 and datC2
+// combineAndScaleData scales datC1 and datC2 separately and stacks them, like rbind(scale(datC1), scale(datC2))
+// in 02601proj.R, so that a shift or change of spread between the conditions does not reach the permutations
 func combineAndScaleData(datC1, datC2 *mat.Dense) *mat.Dense {
 	rows1, cols1 := datC1.Dims()
 	rows2, cols2 := datC2.Dims()
@@ -235,168 +249,32 @@ func combineAndScaleData(datC1, datC2 *mat.Dense) *mat.Dense {
 		panic("Matrices must have the same number of columns")
 	}
 
-	totalRows := rows1 + rows2
-	combinedData := mat.NewDense(totalRows, cols1, nil)
+	scaledC1 := scaleData(datC1)
+	scaledC2 := scaleData(datC2)
+	combinedData := mat.NewDense(rows1+rows2, cols1, nil)
 
 	// Copy datC1
 	for i := 0; i < rows1; i++ {
-		for j := 0; j < cols1; j++ {
-			combinedData.Set(i, j, datC1.At(i, j))
-		}
+		combinedData.SetRow(i, scaledC1.RawRowView(i))
 	}
 
 	// Copy datC2
 	for i := 0; i < rows2; i++ {
-		for j := 0; j < cols1; j++ {
-			combinedData.Set(i+rows1, j, datC2.At(i, j))
-		}
+		combinedData.SetRow(i+rows1, scaledC2.RawRowView(i))
 	}
 
-	return scaleData(combinedData)
+	return combinedData
 }
 
-// permutationProcedureModule2Module calculates dispersion values using permuted data
-func permutationProcedureModule2Module(permutation []int, d *mat.Dense, c1, c2 string, colorh1C1C2 map[string]string) float64 {
-	rows, cols := d.Dims()
-
-	// Create d1 from permuted indices
-	d1 := mat.NewDense(len(permutation), cols, nil)
-	for i, idx := range permutation {
-		for j := 0; j < cols; j++ {
-			d1.Set(i, j, d.At(idx, j))
-		}
-	}
-
-	// Create d2 from remaining indices
-	usedIndices := make(map[int]bool)
-	for _, idx := range permutation {
-		usedIndices[idx] = true
-	}
-
-	d2 := mat.NewDense(rows-len(permutation), cols, nil)
-	j := 0
-	for i := 0; i < rows; i++ {
-		if !usedIndices[i] {
-			for k := 0; k < cols; k++ {
-				d2.Set(j, k, d.At(i, k))
-			}
-			j++
-		}
-	}
-
-	return dispersionModule2Module(c1, c2, d1, d2, colorh1C1C2)
-}
-
-// Function to read the file and return a map
-func readGeneColorFile(filename string) (map[string]string, error) {
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Initialize the map to store gene-color pairs
-	geneColorMap := make(map[string]string)
-
-	// Create a scanner to read through the file line by line
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Split each line by space, assuming that the first column is the gene and the second is the color
-		parts := strings.Fields(line)
-		if len(parts) == 2 {
-			gene := parts[0]
-			color := parts[1]
-			// Add to the map
-			geneColorMap[gene] = color
+// colorsForGenes looks up the color of every gene, using grey for genes missing from the map
+func colorsForGenes(geneIDs []string, geneColorMap map[string]string) []string {
+	colors := make([]string, len(geneIDs))
+	for i, gene := range geneIDs {
+		if color, ok := geneColorMap[gene]; ok {
+			colors[i] = color
 		} else {
-			// Handle unexpected line format
-			fmt.Printf("Skipping invalid line: %s\n", line)
+			colors[i] = greyLabel
 		}
 	}
-
-	// Check for errors during scanning
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return geneColorMap, nil
-}
-
-/*
-
-package main
-
-import (
-	"fmt"
-)
-
-func main() {
-  // Example data as mat.Dense matrices
-  datC1 := mat.NewDense(2, 2, []float64{1, 2, 3, 4})
-  datC2 := mat.NewDense(2, 2, []float64{5, 6, 7, 8})
-
-
-
-  // Specify the file name (change this to the path of your file)
-	colorhC1C2 := "geneModuleColors.txt"
-
-	// Read the file and get the gene-color map
-	geneColorMap, err := readGeneColorFile(filename)
-	if err != nil {
-		fmt.Println("Error reading file:", err)
-		return
-	}
-
-	// Output the map for verification
-	fmt.Println("Gene-Color Map:")
-	for gene, color := range geneColorMap {
-		fmt.Printf("%s: %s\n", gene, color)
-	}
-
-    // Generate permutations
-    numPermutations := 1000
-    permutations := generatePermutations(datC1, datC2, numPermutations)
-
-    // Scale and combine the data
-    d := combineAndScaleData(datC1, datC2)
-
-    // Compute dispersion matrix and null distribution
-    uniqueColors := []string{"red", "blue"}
-    dispersionMatrix := make([][]float64, len(uniqueColors))
-    nullDistrib := make(map[string]map[string][]float64)
-
-    for i, c1 := range uniqueColors {
-        dispersionMatrix[i] = make([]float64, len(uniqueColors))
-        nullDistrib[c1] = make(map[string][]float64)
-        for j, c2 := range uniqueColors {
-            dispersionMatrix[i][j] = dispersionModule2Module(c1, c2, datC1, datC2, colorh1C1C2)
-
-            nullDistrib[c1][c2] = make([]float64, numPermutations)
-            for k, perm := range permutations {
-                nullDistrib[c1][c2][k] = permutationProcedureModule2Module(perm, d, c1, c2, colorh1C1C2)
-            }
-        }
-    }
-
-    // Create permutation summary
-    permutationSummary := make([][]int, len(uniqueColors))
-    for i := range permutationSummary {
-        permutationSummary[i] = make([]int, len(uniqueColors))
-        for j := range permutationSummary[i] {
-            count := 0
-            for _, val := range nullDistrib[uniqueColors[i]][uniqueColors[j]] {
-                if val >= dispersionMatrix[i][j] {
-                    count++
-                }
-            }
-            permutationSummary[i][j] = count
-        }
-    }
-
-    fmt.Println("Dispersion Matrix:", dispersionMatrix)
-    fmt.Println("Permutation Summary:", permutationSummary)
+	return colors
 }
-
-*/
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestModuleDispersionsByHand(t *testing.T) {
+	corC1 := mat.NewSymDense(4, []float64{
+		1, 0.5, 0.2, 0.3,
+		0.5, 1, 0.1, -0.2,
+		0.2, 0.1, 1, 0.6,
+		0.3, -0.2, 0.6, 1,
+	})
+	corC2 := mat.NewSymDense(4, []float64{
+		1, 0.1, 0.2, 0.3,
+		0.1, 1, 0.4, 0.2,
+		0.2, 0.4, 1, 0,
+		0.3, 0.2, 0, 1,
+	})
+	dispersion := moduleDispersions(corC1, corC2, [][]int{{0, 1, 2}, {3}})
+
+	// Within the first module the differences are 0.4, 0 and -0.3. R's sum(difCor)/2 over the full
+	// 3 x 3 matrix is 0.25 and the module has (3^2 - 3)/2 = 3 pairs.
+	if want := math.Sqrt(0.25 / 3); math.Abs(dispersion[0][0]-want) > 1e-12 {
+		t.Errorf("dispersion[0][0] = %v, want %v", dispersion[0][0], want)
+	}
+
+	// Between the modules the differences are 0, -0.4 and 0.6 over 3 x 1 pairs
+	if want := math.Sqrt(0.52 / 3); math.Abs(dispersion[0][1]-want) > 1e-12 || dispersion[1][0] != dispersion[0][1] {
+		t.Errorf("dispersion[0][1] = %v, dispersion[1][0] = %v, want %v", dispersion[0][1], dispersion[1][0], want)
+	}
+}
+
+func TestRandomPermutationReproducible(t *testing.T) {
+	same := true
+	for k := 0; k < 20; k++ {
+		first := randomPermutation(42, k, 9, 5)
+		second := randomPermutation(42, k, 9, 5)
+		other := randomPermutation(43, k, 9, 5)
+		if len(first) != 5 {
+			t.Fatalf("permutation %d has %d samples, want 5", k, len(first))
+		}
+
+		seen := make(map[int]bool)
+		for l, idx := range first {
+			if idx != second[l] {
+				t.Fatalf("seed 42 gave different permutations: %v vs %v", first, second)
+			}
+			if idx < 0 || idx >= 9 || seen[idx] {
+				t.Fatalf("permutation %d = %v is not a sample without replacement", k, first)
+			}
+			seen[idx] = true
+			if idx != other[l] {
+				same = false
+			}
+		}
+	}
+	if same {
+		t.Error("seeds 42 and 43 gave the same permutations")
+	}
+}
+
+func TestSplitRows(t *testing.T) {
+	d := mat.NewDense(4, 2, []float64{
+		1, 2,
+		3, 4,
+		5, 6,
+		7, 8,
+	})
+
+	// d[c(3, 1),] and d[-c(3, 1),] in R
+	d1, d2 := splitRows(d, []int{2, 0})
+	want1 := mat.NewDense(2, 2, []float64{5, 6, 1, 2})
+	want2 := mat.NewDense(2, 2, []float64{3, 4, 7, 8})
+	if !mat.Equal(d1, want1) {
+		t.Errorf("d1 = %v, want %v", mat.Formatted(d1), mat.Formatted(want1))
+	}
+	if !mat.Equal(d2, want2) {
+		t.Errorf("d2 = %v, want %v", mat.Formatted(d2), mat.Formatted(want2))
+	}
+}
+
+func TestPermutedDispersionsActiveModules(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	d := mat.NewDense(14, 7, nil)
+	for i := 0; i < 14; i++ {
+		for j := 0; j < 7; j++ {
+			d.Set(i, j, rng.NormFloat64())
+		}
+	}
+	members := [][]int{{0, 2, 4}, {1, 3}, {5, 6}}
+	permutation := randomPermutation(9, 0, 14, 8)
+
+	all := permutedDispersions(permutation, d, members, nil)
+	d1, d2 := splitRows(d, permutation)
+	direct := moduleDispersions(spearmanMatrix(d1), spearmanMatrix(d2), members)
+	partial := permutedDispersions(permutation, d, members, []bool{true, false, true})
+
+	for a := range members {
+		for b := range members {
+			if all[a][b] != direct[a][b] {
+				t.Errorf("permuted %d-%d = %v, want %v", a, b, all[a][b], direct[a][b])
+			}
+
+			// Only the genes of active modules are correlated, which leaves their dispersions unchanged
+			want := 0.0
+			if a != 1 && b != 1 {
+				want = all[a][b]
+			}
+			if math.Abs(partial[a][b]-want) > 1e-12 {
+				t.Errorf("active permuted %d-%d = %v, want %v", a, b, partial[a][b], want)
+			}
+		}
+	}
+}
+
+func TestCombineAndScaleDataPerCondition(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	datC1 := mat.NewDense(6, 4, nil)
+	datC2 := mat.NewDense(5, 4, nil)
+	for _, m := range []*mat.Dense{datC1, datC2} {
+		rows, cols := m.Dims()
+		for i := 0; i < rows; i++ {
+			for j := 0; j < cols; j++ {
+				m.Set(i, j, rng.NormFloat64())
+			}
+		}
+	}
+
+	// Shift the first gene and stretch the second in condition 2 only
+	shifted := mat.DenseCopyOf(datC2)
+	for i := 0; i < 5; i++ {
+		shifted.Set(i, 0, shifted.At(i, 0)+10)
+		shifted.Set(i, 1, 3*shifted.At(i, 1))
+	}
+
+	d := combineAndScaleData(datC1, datC2)
+	dShifted := combineAndScaleData(datC1, shifted)
+	if !mat.EqualApprox(d, dShifted, 1e-12) {
+		t.Fatalf("scaled data changed with a shift in one condition:\n%v\n%v", mat.Formatted(d), mat.Formatted(dShifted))
+	}
+
+	members := [][]int{{0, 1}, {2, 3}}
+	for k := 0; k < 5; k++ {
+		permutation := randomPermutation(2, k, 11, 6)
+		want := permutedDispersions(permutation, d, members, nil)
+		got := permutedDispersions(permutation, dShifted, members, nil)
+		for a := range members {
+			for b := range members {
+				if math.Abs(got[a][b]-want[a][b]) > 1e-12 {
+					t.Errorf("permutation %d: dispersion %d-%d = %v after the shift, want %v", k, a, b, got[a][b], want[a][b])
+				}
+			}
+		}
+	}
+
+	// Every condition has mean 0 on its own
+	for j := 0; j < 4; j++ {
+		column := getColumn(d, j)
+		if m := meanFloat(column[:6]); math.Abs(m) > 1e-12 {
+			t.Errorf("gene %d has mean %v in condition 1, want 0", j, m)
+		}
+		if m := meanFloat(column[6:]); math.Abs(m) > 1e-12 {
+			t.Errorf("gene %d has mean %v in condition 2, want 0", j, m)
+		}
+	}
+}
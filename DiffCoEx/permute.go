@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"github.com/kcw27/PFS_Group_Project/multipletesting"
+)
+
+// sequentialBatch is the number of permutations run between checks of the Besag-Clifford stopping rule.
+// It is fixed so that the result does not depend on the number of goroutines.
+const sequentialBatch = 50
+
+// permutationOptions are the user defined parameters of the module permutation test
+type permutationOptions struct {
+	Permutations int
+	Seed         int64
+	// H is the number of exceedances after which a pair of modules stops being permuted
+	// (Besag-Clifford sequential test); 0 runs every permutation for every pair
+	H int
+	// Strata restricts the permutations to shuffle samples within strata (nil = shuffle all samples)
+	Strata *sampleStrata
+	// Threads is the number of goroutines (0 = all CPUs)
+	Threads int
+	// Progress receives progress reports (nil = no reporting)
+	Progress io.Writer
+}
+
+// pairTest is the permutation test of one pair of modules
+type pairTest struct {
+	// Exceedances counts the permutations with a dispersion equal to or higher than the observed one,
+	// out of the Permutations used for the pair
+	Exceedances  int
+	Permutations int
+	// Stopped is set when the pair reached h exceedances before the last permutation
+	Stopped bool
+	P       float64
+	// PAdjusted is P corrected for multiple testing over all pairs of modules
+	PAdjusted float64
+	// PMaxT is Westfall and Young's step-down maxT adjusted p-value of the standardized dispersion
+	// (NaN unless every pair was evaluated on every permutation)
+	PMaxT float64
+	// Tail is the generalized Pareto extrapolation of P for pairs without any exceedance (nil otherwise,
+	// or when no tail fits)
+	Tail *tailEstimate
+}
+
+// permutationResult holds the observed module to module dispersions and their null distributions
+type permutationResult struct {
+	// Seed is the seed the permutations were drawn from
+	Seed int64
+	// Requested is the number of permutations asked for and Completed the number that finished,
+	// which is lower if the run was interrupted or every pair stopped early
+	Requested   int
+	Completed   int
+	Interrupted bool
+	H           int
+	// Strata are the metadata columns the permutations were restricted by (nil = free permutations)
+	Strata []string
+	// Adjust is the multiple testing correction of the p-values (see multipletesting.Adjust)
+	Adjust     string
+	Modules    []string
+	Dispersion [][]float64
+	// Null[i][j] holds the dispersion of modules i and j on the first Tests[i][j].Permutations permutations
+	Null  [][][]float64
+	Tests [][]pairTest
+}
+
+// sequentialPValue is the p-value of a pair of modules with b exceedances out of m permutations.
+// A pair that stopped early at its h-th exceedance gets Besag and Clifford's h/m; otherwise the usual
+// (b+1)/(m+1), which never reports a p-value of 0.
+func sequentialPValue(b, m, h int, stopped bool) float64 {
+	if stopped {
+		return float64(h) / float64(m)
+	}
+	return float64(b+1) / float64(m+1)
+}
+
+// modulePermutationTest computes the dispersion of every pair of modules between the two conditions
+// and its null distribution over random splits of the samples of both conditions, each condition scaled
+// on its own before they are combined, as in the permutation section of 02601proj.R. Only the module
+// genes are kept, and each permutation correlates them once per condition for all pairs of modules.
+//
+// With opts.H > 0 a pair stops being permuted once it has reached H exceedances (Besag and Clifford's
+// sequential Monte Carlo test), and permutations stop altogether when every pair has. Permutations run
+// in batches spread over goroutines; permutation k always uses its own random stream and the stopping
+// rule only looks at permutations in order, so the result only depends on the seed. If ctx is cancelled
+// the permutations finished so far (without gaps) are returned together with ctx.Err().
+//
+// With opts.Strata the condition labels are only shuffled within each stratum, keeping the size of
+// both conditions in every stratum.
+func modulePermutationTest(ctx context.Context, datC1, datC2 *labelledMatrix, colorh1C1C2 map[string]string, modules []string, opts permutationOptions) (*permutationResult, error) {
+	subC1, members := moduleSubmatrix(datC1, colorh1C1C2, modules)
+	subC2, _ := moduleSubmatrix(datC2, colorh1C1C2, modules)
+	rows1, _ := subC1.Dims()
+	rows2, _ := subC2.Dims()
+	d := combineAndScaleData(subC1, subC2)
+
+	n := len(modules)
+	result := &permutationResult{
+		Seed:       opts.Seed,
+		Requested:  opts.Permutations,
+		H:          opts.H,
+		Modules:    modules,
+		Dispersion: moduleDispersions(spearmanMatrix(subC1), spearmanMatrix(subC2), members),
+		Null:       make([][][]float64, n),
+		Tests:      make([][]pairTest, n),
+	}
+	for i := range modules {
+		result.Null[i] = make([][]float64, n)
+		result.Tests[i] = make([]pairTest, n)
+	}
+	if opts.Strata != nil {
+		result.Strata = opts.Strata.Columns
+	}
+
+	progress := newProgressReporter(opts.Progress, "Permutations", opts.Permutations)
+	defer progress.finish()
+
+	null := make([][][]float64, sequentialBatch)
+	var err error
+	for start := 0; start < opts.Permutations && err == nil; start += sequentialBatch {
+		// Only modules that still take part in an active pair need to be correlated
+		active := make([]bool, n)
+		anyActive := false
+		for i := range modules {
+			for j := i; j < n; j++ {
+				if !result.Tests[i][j].Stopped {
+					active[i], active[j], anyActive = true, true, true
+				}
+			}
+		}
+		if !anyActive {
+			break
+		}
+
+		batch := sequentialBatch
+		if start+batch > opts.Permutations {
+			batch = opts.Permutations - start
+		}
+		work := func(ctx context.Context, k int) bool {
+			permutation := drawPermutation(opts.Seed, start+k, rows1, rows2, opts.Strata)
+			null[k] = permutedDispersions(permutation, d, members, active)
+			return true
+		}
+		var finished []bool
+		finished, err = runPermutations(ctx, batch, opts.Threads, work, progress)
+
+		// Go through the finished permutations in order, up to the first one missing
+		for k := 0; k < batch && finished[k]; k++ {
+			for i := range modules {
+				for j := i; j < n; j++ {
+					test := &result.Tests[i][j]
+					if test.Stopped {
+						continue
+					}
+					value := null[k][i][j]
+					result.Null[i][j] = append(result.Null[i][j], value)
+					test.Permutations++
+					if value >= result.Dispersion[i][j] {
+						test.Exceedances++
+					}
+					if opts.H > 0 && test.Exceedances >= opts.H {
+						test.Stopped = true
+					}
+				}
+			}
+			result.Completed++
+		}
+	}
+
+	for i := range modules {
+		for j := i; j < n; j++ {
+			test := &result.Tests[i][j]
+			// Reaching h exceedances on the very last permutation is not an early stop
+			test.Stopped = test.Stopped && test.Permutations < opts.Permutations
+			test.P = sequentialPValue(test.Exceedances, test.Permutations, opts.H, test.Stopped)
+			result.Tests[j][i] = *test
+			result.Null[j][i] = result.Null[i][j]
+		}
+	}
+	result.Interrupted = err != nil
+	return result, err
+}
+
+// adjustPValues corrects the p-values of every unordered pair of modules as one family of tests
+func (r *permutationResult) adjustPValues(method string) error {
+	var p []float64
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			p = append(p, r.Tests[i][j].P)
+		}
+	}
+	adjusted, err := multipletesting.Adjust(p, method)
+	if err != nil {
+		return err
+	}
+
+	k := 0
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			r.Tests[i][j].PAdjusted = adjusted[k]
+			r.Tests[j][i].PAdjusted = adjusted[k]
+			k++
+		}
+	}
+	r.Adjust = method
+	return nil
+}
+
+// westfallYoung computes the step-down maxT adjusted p-values of all unordered pairs of modules from
+// their standardized dispersions. Every pair must have been evaluated on the same permutations, which
+// is not the case once a pair stopped early; the adjusted p-values are then NaN and false is returned.
+func (r *permutationResult) westfallYoung() bool {
+	var observed []float64
+	var null [][]float64
+	shared := r.Completed > 0
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			if r.Tests[i][j].Permutations != r.Completed {
+				shared = false
+			}
+			z, zNull := standardize(r.Dispersion[i][j], r.Null[i][j])
+			observed = append(observed, z)
+			null = append(null, zNull)
+		}
+	}
+
+	var adjusted []float64
+	if shared {
+		adjusted = maxTAdjust(observed, null)
+	}
+	k := 0
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			p := math.NaN()
+			if shared {
+				p = adjusted[k]
+			}
+			r.Tests[i][j].PMaxT = p
+			r.Tests[j][i].PMaxT = p
+			k++
+		}
+	}
+	return shared
+}
+
+// tailPValues extrapolates the p-value of every pair of modules whose observed dispersion was never
+// reached by a permutation, where the permutation p-value only says p < 1/(m+1). Each pair draws its
+// bootstrap samples from its own stream derived from the seed. It returns the number of pairs with a tail fit.
+func (r *permutationResult) tailPValues() int {
+	fitted, k := 0, 0
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			if r.Tests[i][j].Exceedances == 0 {
+				if tail, ok := gpdTailPValue(r.Dispersion[i][j], r.Null[i][j], permutationRand(^r.Seed, k)); ok {
+					r.Tests[i][j].Tail = &tail
+					r.Tests[j][i].Tail = &tail
+					fitted++
+				}
+			}
+			k++
+		}
+	}
+	return fitted
+}
+
+// summary counts, for every pair of modules, the permutations with a dispersion equal to or higher
+// than the observed one (permutationSummary in 02601proj.R)
+func (r *permutationResult) summary() [][]int {
+	counts := make([][]int, len(r.Modules))
+	for i := range r.Modules {
+		counts[i] = make([]int, len(r.Modules))
+		for j := range r.Modules {
+			for _, v := range r.Null[i][j] {
+				if v >= r.Dispersion[i][j] {
+					counts[i][j]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// saveLabelledMatrix writes a square module by module matrix as CSV with the module names as header
+// and first column. A non-empty comment is written first as a line starting with "#".
+func saveLabelledMatrix(filename, comment string, labels []string, value func(i, j int) string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if comment != "" {
+		if _, err := fmt.Fprintf(file, "# %s\n", comment); err != nil {
+			return err
+		}
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write(append([]string{"module"}, labels...)); err != nil {
+		return err
+	}
+	for i, label := range labels {
+		row := []string{label}
+		for j := range labels {
+			row = append(row, value(i, j))
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveNullDistributions writes one CSV row per pair of modules (each unordered pair once) followed by
+// the dispersion of every finished permutation, or NA after the pair stopped. The first line records the seed.
+func saveNullDistributions(r *permutationResult, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "# %s\n", r.seedComment()); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if len(r.Modules) == 0 {
+		return writer.Write([]string{"module1", "module2"})
+	}
+	header := []string{"module1", "module2"}
+	for k := 0; k < r.Completed; k++ {
+		header = append(header, fmt.Sprintf("perm%d", k+1))
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			row := []string{r.Modules[i], r.Modules[j]}
+			for _, v := range r.Null[i][j] {
+				row = append(row, strconv.FormatFloat(v, 'g', -1, 64))
+			}
+			// Pairs that stopped early were not permuted any further
+			for len(row) < r.Completed+2 {
+				row = append(row, "NA")
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seedComment describes how the null distributions were drawn, so a run can be repeated
+func (r *permutationResult) seedComment() string {
+	comment := fmt.Sprintf("seed %d, %d permutations", r.Seed, r.Requested)
+	if len(r.Strata) > 0 {
+		comment += fmt.Sprintf(", within strata of %s", strings.Join(r.Strata, ", "))
+	}
+	if r.H > 0 {
+		comment += fmt.Sprintf(", sequential stopping at h = %d", r.H)
+	}
+	if r.Interrupted {
+		comment += fmt.Sprintf(", interrupted after %d", r.Completed)
+	}
+	return comment
+}
+
+// savePairPValues writes one row per pair of modules (each unordered pair once) with the observed
+// dispersion, the exceedances, the number of permutations used, the p-value, the adjusted p-value,
+// whose column is named after the correction (p.BH, p.holm, ...), the maxT adjusted p-value and, for pairs
+// without exceedances, the generalized Pareto tail p-value with its 95% confidence interval, tail size and
+// goodness of fit p-value
+func savePairPValues(r *permutationResult, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "# %s\n", r.seedComment()); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	if err := writer.Write([]string{"module1", "module2", "dispersion", "exceedances", "permutations", "stopped", "p", "p." + r.Adjust, "p.maxT",
+		"p.gpd", "p.gpd.lower", "p.gpd.upper", "gpd.tail", "gpd.fit"}); err != nil {
+		return err
+	}
+	for i := range r.Modules {
+		for j := i; j < len(r.Modules); j++ {
+			test := r.Tests[i][j]
+			row := []string{
+				r.Modules[i], r.Modules[j],
+				strconv.FormatFloat(r.Dispersion[i][j], 'g', -1, 64),
+				strconv.Itoa(test.Exceedances),
+				strconv.Itoa(test.Permutations),
+				strconv.FormatBool(test.Stopped),
+				strconv.FormatFloat(test.P, 'g', -1, 64),
+				strconv.FormatFloat(test.PAdjusted, 'g', -1, 64),
+				formatNA(test.PMaxT),
+			}
+			if tail := test.Tail; tail != nil {
+				row = append(row, formatNA(tail.P), formatNA(tail.Lower), formatNA(tail.Upper),
+					strconv.Itoa(tail.Exceedances), formatNA(tail.GoodnessOfFit))
+			} else {
+				row = append(row, "NA", "NA", "NA", "NA", "NA")
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatNA formats a number for CSV output, writing NaN as R's NA
+func formatNA(v float64) string {
+	if math.IsNaN(v) {
+		return "NA"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// reportGenes prints how many genes are in the list, followed by the first few of them
+func reportGenes(what string, genes []string) {
+	if len(genes) == 0 {
+		return
+	}
+	const shown = 5
+	if len(genes) <= shown {
+		fmt.Printf("%d %s: %s\n", len(genes), what, strings.Join(genes, ", "))
+		return
+	}
+	fmt.Printf("%d %s: %s, ...\n", len(genes), what, strings.Join(genes[:shown], ", "))
+}
+
+// runPermute runs the module to module permutation test of 02601proj.R on two condition files and a
+// module file, leaving out the grey (unassigned) genes
+func runPermute(args []string) error {
+	fs := flag.NewFlagSet("permute", flag.ExitOnError)
+	fileC1 := fs.String("c1", "", "condition 1 expression file (output of preprocess)")
+	fileC2 := fs.String("c2", "", "condition 2 expression file (output of preprocess)")
+	modulesFile := fs.String("modules", "", "gene module file (\"gene color\" per line)")
+	numPermutations := fs.Int("n", 1000, "number of permutations")
+	seed := fs.Int64("seed", seedFromClock, "random seed for the permutations (negative = seed from the clock)")
+	h := fs.Int("h", 0, "stop permuting a pair of modules after h exceedances (Besag-Clifford, e.g. 10; 0 = run all)")
+	metadataFile := fs.String("metadata", "", "sample metadata file with a header, one row per sample of c1 then c2, for -strata")
+	strataColumns := fs.String("strata", "", "comma separated metadata columns (e.g. agent,time); permutations only shuffle samples within their strata")
+	threads := fs.Int("threads", 0, "goroutines used for the permutations (0 = all CPUs)")
+	adjust := fs.String("adjust", "BH", "multiple testing correction of the pair p-values: "+strings.Join(multipletesting.Methods, ", "))
+	dispersionOut := fs.String("dispersion", "dispersion_matrix.csv", "output module to module dispersion matrix")
+	nullOut := fs.String("null", "null_distributions.csv", "output null distributions")
+	summaryOut := fs.String("summary", "permutation_summary.csv", "output permutation summary counts")
+	pvaluesOut := fs.String("pvalues", "permutation_pvalues.csv", "output p-value of every pair of modules")
+	fs.Parse(args)
+
+	if *fileC1 == "" || *fileC2 == "" || *modulesFile == "" {
+		fs.Usage()
+		return fmt.Errorf("-c1, -c2 and -modules are required")
+	}
+
+	dataC1, dataC2, err := readConditions(*fileC1, *fileC2)
+	if err != nil {
+		return err
+	}
+	colorh1C1C2, err := genecolor.ReadFile(*modulesFile)
+	if err != nil {
+		return err
+	}
+
+	missing, unassigned := moduleMembership(dataC1.GeneIDs, colorh1C1C2)
+	reportGenes(fmt.Sprintf("genes in %s missing from the expression data", *modulesFile), missing)
+	reportGenes(fmt.Sprintf("genes in the expression data without a module (treated as %s)", greyLabel), unassigned)
+
+	modules, _ := moduleColumns(colorsForGenes(dataC1.GeneIDs, colorh1C1C2))
+	if len(modules) == 0 {
+		return fmt.Errorf("no modules besides %s match the genes of the expression data", greyLabel)
+	}
+
+	if _, err := multipletesting.Adjust(nil, *adjust); err != nil {
+		return err
+	}
+	*seed = resolveSeed(*seed)
+
+	datC1 := &labelledMatrix{Data: samplesByGenes(dataC1.Data), GeneIDs: dataC1.GeneIDs}
+	datC2 := &labelledMatrix{Data: samplesByGenes(dataC2.Data), GeneIDs: dataC2.GeneIDs}
+
+	strata, err := strataFromFlags(*metadataFile, *strataColumns, datC1, datC2, *numPermutations)
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C stops the permutations; the ones finished so far are still written out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Running %d permutations for %d modules (seed %d)...\n", *numPermutations, len(modules), *seed)
+	opts := permutationOptions{Permutations: *numPermutations, Seed: *seed, H: *h, Strata: strata, Threads: *threads, Progress: os.Stderr}
+	result, runErr := modulePermutationTest(ctx, datC1, datC2, colorh1C1C2, modules, opts)
+	stop()
+	if err := result.adjustPValues(*adjust); err != nil {
+		return err
+	}
+	if !result.westfallYoung() {
+		fmt.Println("maxT adjusted p-values need every pair on every permutation; p.maxT is NA (run with -h 0)")
+	}
+	if fitted := result.tailPValues(); fitted > 0 {
+		fmt.Printf("Extrapolated the p-value of %d pairs without exceedances from a generalized Pareto tail\n", fitted)
+	}
+
+	err = saveLabelledMatrix(*dispersionOut, "", modules, func(i, j int) string {
+		return strconv.FormatFloat(result.Dispersion[i][j], 'g', -1, 64)
+	})
+	if err != nil {
+		return err
+	}
+	if err := saveNullDistributions(result, *nullOut); err != nil {
+		return err
+	}
+	counts := result.summary()
+	err = saveLabelledMatrix(*summaryOut, result.seedComment(), modules, func(i, j int) string {
+		return strconv.Itoa(counts[i][j])
+	})
+	if err != nil {
+		return err
+	}
+	if err := savePairPValues(result, *pvaluesOut); err != nil {
+		return err
+	}
+
+	if runErr != nil {
+		return fmt.Errorf("interrupted after %d of %d permutations, partial results saved to %s, %s, %s, %s",
+			result.Completed, result.Requested, *dispersionOut, *nullOut, *summaryOut, *pvaluesOut)
+	}
+	fmt.Printf("Files saved: %s, %s, %s, %s\n", *dispersionOut, *nullOut, *summaryOut, *pvaluesOut)
+	return nil
+}
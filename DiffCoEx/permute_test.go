@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestPermutationSummary(t *testing.T) {
+	result := &permutationResult{
+		Modules:    []string{"blue", "turquoise"},
+		Dispersion: [][]float64{{0.5, 0.2}, {0.2, 0.1}},
+		Null: [][][]float64{
+			{{0.1, 0.6, 0.5}, {0.3, 0.1, 0.2}},
+			{{0.3, 0.1, 0.2}, {0.2, 0.3, 0.4}},
+		},
+	}
+
+	counts := result.summary()
+	want := [][]int{{2, 2}, {2, 3}}
+	for i := range want {
+		for j := range want[i] {
+			if counts[i][j] != want[i][j] {
+				t.Fatalf("summary = %v, want %v", counts, want)
+			}
+		}
+	}
+}
+
+func TestModuleMembershipByGeneID(t *testing.T) {
+	colorh1C1C2 := map[string]string{"1367452_at": "blue", "1367453_at": "blue", "1367454_at": "red", "absent_at": "red"}
+	geneIDs := []string{"1367452_at", "1367453_at", "1367454_at", "1367455_at"}
+
+	missing, unassigned := moduleMembership(geneIDs, colorh1C1C2)
+	if len(missing) != 1 || missing[0] != "absent_at" {
+		t.Errorf("missing = %v, want [absent_at]", missing)
+	}
+	if len(unassigned) != 1 || unassigned[0] != "1367455_at" {
+		t.Errorf("unassigned = %v, want [1367455_at]", unassigned)
+	}
+
+	// The columns of a module are found through the probe IDs
+	data := &labelledMatrix{
+		Data:    mat.NewDense(2, 4, []float64{1, 2, 3, 4, 5, 6, 7, 8}),
+		GeneIDs: geneIDs,
+	}
+	sub, members := moduleSubmatrix(data, colorh1C1C2, []string{"blue", "red"})
+	want := mat.NewDense(2, 3, []float64{1, 2, 3, 5, 6, 7})
+	if !mat.Equal(sub, want) {
+		t.Errorf("module columns = %v, want %v", mat.Formatted(sub), mat.Formatted(want))
+	}
+	if len(members[0]) != 2 || members[0][1] != 1 || len(members[1]) != 1 || members[1][0] != 2 {
+		t.Errorf("members = %v, want [[0 1] [2]]", members)
+	}
+}
+
+// randomConditions returns two conditions of random expression with a blue and a red module of 3 genes
+func randomConditions(seed int64) (*labelledMatrix, *labelledMatrix, map[string]string) {
+	rng := rand.New(rand.NewSource(seed))
+	geneIDs := []string{"a", "b", "c", "d", "e", "f"}
+	colorh1C1C2 := map[string]string{"a": "blue", "b": "blue", "c": "blue", "d": "red", "e": "red", "f": "red"}
+	datC1 := &labelledMatrix{Data: mat.NewDense(6, 6, nil), GeneIDs: geneIDs}
+	datC2 := &labelledMatrix{Data: mat.NewDense(5, 6, nil), GeneIDs: geneIDs}
+	for _, m := range []*mat.Dense{datC1.Data, datC2.Data} {
+		rows, cols := m.Dims()
+		for i := 0; i < rows; i++ {
+			for j := 0; j < cols; j++ {
+				m.Set(i, j, rng.NormFloat64())
+			}
+		}
+	}
+	return datC1, datC2, colorh1C1C2
+}
+
+func TestModulePermutationTestIndependentOfThreads(t *testing.T) {
+	datC1, datC2, colorh1C1C2 := randomConditions(7)
+	modules := []string{"blue", "red"}
+	one, err := modulePermutationTest(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		permutationOptions{Permutations: 40, Seed: 11, Threads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	many, err := modulePermutationTest(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		permutationOptions{Permutations: 40, Seed: 11, Threads: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range modules {
+		for j := range modules {
+			if len(one.Null[i][j]) != 40 {
+				t.Fatalf("null distribution has %d values, want 40", len(one.Null[i][j]))
+			}
+			for k := range one.Null[i][j] {
+				if one.Null[i][j][k] != many.Null[i][j][k] {
+					t.Fatalf("Null[%d][%d][%d] = %v with 1 thread, %v with 32", i, j, k, one.Null[i][j][k], many.Null[i][j][k])
+				}
+			}
+		}
+	}
+}
+
+func TestSequentialPValue(t *testing.T) {
+	tests := []struct {
+		b, m, h int
+		stopped bool
+		want    float64
+	}{
+		{0, 1000, 10, false, 1.0 / 1001},
+		{3, 1000, 10, false, 4.0 / 1001},
+		{10, 40, 10, true, 0.25},
+		{10, 10, 10, true, 1},
+	}
+	for _, test := range tests {
+		if got := sequentialPValue(test.b, test.m, test.h, test.stopped); got != test.want {
+			t.Errorf("sequentialPValue(%d, %d, %d, %v) = %v, want %v", test.b, test.m, test.h, test.stopped, got, test.want)
+		}
+	}
+}
+
+func TestSequentialStopping(t *testing.T) {
+	datC1, datC2, colorh1C1C2 := randomConditions(5)
+	modules := []string{"blue", "red"}
+	full, err := modulePermutationTest(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		permutationOptions{Permutations: 300, Seed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequential, err := modulePermutationTest(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		permutationOptions{Permutations: 300, Seed: 2, H: 5, Threads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range modules {
+		for j := range modules {
+			test := sequential.Tests[i][j]
+			// Random data is not differentially coexpressed, so every pair reaches 5 exceedances early
+			if !test.Stopped || test.Exceedances != 5 || test.P != 5/float64(test.Permutations) {
+				t.Errorf("pair %d-%d = %+v, want a stop at 5 exceedances", i, j, test)
+			}
+			// The pair stops at its 5th exceedance in the full null distribution
+			count := 0
+			for k, v := range full.Null[i][j][:test.Permutations] {
+				if v != sequential.Null[i][j][k] {
+					t.Fatalf("pair %d-%d permutation %d = %v, want %v", i, j, k, sequential.Null[i][j][k], v)
+				}
+				if v >= full.Dispersion[i][j] {
+					count++
+				}
+			}
+			if count != 5 || full.Null[i][j][test.Permutations-1] < full.Dispersion[i][j] {
+				t.Errorf("pair %d-%d stopped after %d permutations with %d exceedances", i, j, test.Permutations, count)
+			}
+		}
+	}
+	if sequential.Completed >= 300 {
+		t.Errorf("Completed = %d, want an early stop", sequential.Completed)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// defaultPowers are the candidate soft thresholding powers tried by WGCNA's pickSoftThreshold
+var defaultPowers = []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 16, 18, 20}
+
+// softThresholdFit is one row of the pickSoftThreshold table
+type softThresholdFit struct {
+	Power float64
+	// RSquared is the signed scale-free fit -sign(slope)*R^2 (SFT.R.sq in WGCNA)
+	RSquared float64
+	Slope    float64
+	MeanK    float64
+	MedianK  float64
+	MaxK     float64
+}
+
+// scaleFreeFitIndex fits log10 p(k) against log10 k over nBreaks connectivity bins, following WGCNA's
+// scaleFreeFitIndex, and returns the R^2 and slope of the fit
+func scaleFreeFitIndex(k []float64, nBreaks int) (float64, float64) {
+	minK, maxK := k[0], k[0]
+	for _, v := range k {
+		minK = math.Min(minK, v)
+		maxK = math.Max(maxK, v)
+	}
+	width := maxK - minK
+
+	// cut(k, nBreaks): equal bins over the range, widened by 0.1% at both ends, closed on the right
+	lower := minK - width/1000
+	upper := maxK + width/1000
+	sums := make([]float64, nBreaks)
+	counts := make([]int, nBreaks)
+	for _, v := range k {
+		bin := nBreaks - 1
+		if width > 0 {
+			bin = int(math.Ceil((v-lower)/(upper-lower)*float64(nBreaks))) - 1
+			if bin < 0 {
+				bin = 0
+			} else if bin >= nBreaks {
+				bin = nBreaks - 1
+			}
+		}
+		sums[bin] += v
+		counts[bin]++
+	}
+
+	logK := make([]float64, nBreaks)
+	logP := make([]float64, nBreaks)
+	for b := 0; b < nBreaks; b++ {
+		// Empty bins (and bins averaging to zero) use the midpoint of the unwidened bin
+		dk := math.NaN()
+		if counts[b] > 0 {
+			dk = sums[b] / float64(counts[b])
+		}
+		if math.IsNaN(dk) || dk == 0 {
+			dk = minK + width*(float64(b)+0.5)/float64(nBreaks)
+		}
+		logK[b] = math.Log10(dk)
+		logP[b] = math.Log10(float64(counts[b])/float64(len(k)) + 1e-9)
+	}
+
+	alpha, slope := stat.LinearRegression(logK, logP, nil, false)
+	rsq := stat.RSquared(logK, logP, nil, alpha, slope)
+	return rsq, slope
+}
+
+// connectivities returns, for every power, the connectivity k_i = sum_j a_ij of each gene, where the
+// adjacency of genes i and j at a given power is adjacency(value(i, j), power). Rows are split over goroutines.
+func connectivities(n int, value func(i, j int) float64, adjacency func(v, power float64) float64, powers []float64) [][]float64 {
+	k := make([][]float64, len(powers))
+	for p := range powers {
+		k[p] = make([]float64, n)
+	}
+
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				for j := 0; j < n; j++ {
+					if i == j {
+						continue
+					}
+					v := value(i, j)
+					for p, power := range powers {
+						k[p][i] += adjacency(v, power)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return k
+}
+
+// pickSoftThreshold reports the scale-free fit and connectivity summary of a network for each power
+func pickSoftThreshold(n int, value func(i, j int) float64, adjacency func(v, power float64) float64, powers []float64) []softThresholdFit {
+	k := connectivities(n, value, adjacency, powers)
+
+	fits := make([]softThresholdFit, len(powers))
+	for p, power := range powers {
+		rsq, slope := scaleFreeFitIndex(k[p], 10)
+		sign := 1.0
+		if slope > 0 {
+			sign = -1.0
+		}
+
+		sorted := append([]float64{}, k[p]...)
+		sort.Float64s(sorted)
+		median := sorted[n/2]
+		if n%2 == 0 {
+			median = (sorted[n/2-1] + sorted[n/2]) / 2
+		}
+
+		fits[p] = softThresholdFit{
+			Power:    power,
+			RSquared: sign * rsq,
+			Slope:    slope,
+			MeanK:    meanFloat(k[p]),
+			MedianK:  median,
+			MaxK:     sorted[n-1],
+		}
+	}
+	return fits
+}
+
+// conditionSoftThreshold evaluates the unsigned network |cor|^power of one condition
+func conditionSoftThreshold(cor *mat.SymDense, powers []float64) []softThresholdFit {
+	value := func(i, j int) float64 { return math.Abs(cor.At(i, j)) }
+	adjacency := func(v, power float64) float64 { return math.Pow(v, power) }
+	return pickSoftThreshold(cor.SymmetricDim(), value, adjacency, powers)
+}
+
+// differentialSoftThreshold evaluates the DiffCoEx differential network (|AdjC1-AdjC2|/2)^(power/2)
+func differentialSoftThreshold(adjC1, adjC2 *mat.SymDense, powers []float64) []softThresholdFit {
+	value := func(i, j int) float64 { return math.Abs(adjC1.At(i, j)-adjC2.At(i, j)) / 2 }
+	adjacency := func(v, power float64) float64 { return math.Pow(v, power/2) }
+	return pickSoftThreshold(adjC1.SymmetricDim(), value, adjacency, powers)
+}
+
+// recommendedPower returns the lowest power whose signed scale-free R^2 reaches the target,
+// and false if none does
+func recommendedPower(fits []softThresholdFit, target float64) (float64, bool) {
+	best, found := 0.0, false
+	for _, fit := range fits {
+		if fit.RSquared >= target && (!found || fit.Power < best) {
+			best, found = fit.Power, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScaleFreeFitIndex(t *testing.T) {
+	// Connectivities following p(k) ~ k^-2 between 1 and 10 should fit a straight line on the log-log scale
+	var k []float64
+	for i := 0; i < 2000; i++ {
+		u := 0.9 * float64(i) / 2000
+		k = append(k, math.Pow(1-u, -1))
+	}
+	rsq, slope := scaleFreeFitIndex(k, 10)
+	if rsq < 0.8 || slope >= 0 {
+		t.Errorf("scaleFreeFitIndex() = (%v, %v), want a good fit with negative slope", rsq, slope)
+	}
+}
+
+func TestRecommendedPower(t *testing.T) {
+	fits := []softThresholdFit{
+		{Power: 1, RSquared: 0.2},
+		{Power: 4, RSquared: 0.87},
+		{Power: 2, RSquared: 0.6},
+		{Power: 6, RSquared: 0.9},
+	}
+	if power, ok := recommendedPower(fits, 0.85); !ok || power != 4 {
+		t.Errorf("recommendedPower() = (%v, %v), want (4, true)", power, ok)
+	}
+	if _, ok := recommendedPower(fits, 0.95); ok {
+		t.Errorf("recommendedPower() found a power above 0.95")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// sampleStrata restricts the permutations to shuffle the condition labels within groups of samples
+type sampleStrata struct {
+	// Columns are the metadata columns the strata are made of
+	Columns []string
+	// Labels[s] names stratum s by its values of the columns, Samples[s] holds the positions of its samples
+	// in rbind(datC1, datC2) and C1[s] how many of them are in condition 1
+	Labels  []string
+	Samples [][]int
+	C1      []int
+}
+
+// readSampleStrata groups the samples by their values of the given columns of a metadata file. The file
+// is comma or tab separated with a header, and has one row per sample: the rows1 samples of condition 1,
+// in the order of the columns of the condition 1 expression file, followed by the rows2 samples of condition 2.
+func readSampleStrata(filename string, columns []string, rows1, rows2 int) (*sampleStrata, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading header: %v", filename, err)
+	}
+	if len(header) == 1 && strings.Contains(header[0], "\t") {
+		// Tab separated: start again with the right separator
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		reader = csv.NewReader(file)
+		reader.Comma = '\t'
+		reader.FieldsPerRecord = -1
+		if header, err = reader.Read(); err != nil {
+			return nil, fmt.Errorf("%s: reading header: %v", filename, err)
+		}
+	}
+
+	columns = append([]string{}, columns...)
+	fields := make([]int, len(columns))
+	for c := range columns {
+		columns[c] = strings.TrimSpace(columns[c])
+		column := columns[c]
+		fields[c] = -1
+		for f, name := range header {
+			if strings.TrimSpace(name) == column {
+				fields[c] = f
+			}
+		}
+		if fields[c] < 0 {
+			return nil, fmt.Errorf("%s has no column %q (columns: %s)", filename, column, strings.Join(header, ", "))
+		}
+	}
+
+	strata := &sampleStrata{Columns: columns}
+	position := make(map[string]int)
+	sample := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]string, len(fields))
+		for c, f := range fields {
+			if f >= len(record) {
+				return nil, fmt.Errorf("%s: sample %d has no value for %s", filename, sample+1, columns[c])
+			}
+			values[c] = strings.TrimSpace(record[f])
+		}
+		label := strings.Join(values, "/")
+		s, ok := position[label]
+		if !ok {
+			s = len(strata.Labels)
+			position[label] = s
+			strata.Labels = append(strata.Labels, label)
+			strata.Samples = append(strata.Samples, nil)
+			strata.C1 = append(strata.C1, 0)
+		}
+		strata.Samples[s] = append(strata.Samples[s], sample)
+		if sample < rows1 {
+			strata.C1[s]++
+		}
+		sample++
+	}
+
+	if sample != rows1+rows2 {
+		return nil, fmt.Errorf("%s describes %d samples, but the conditions have %d + %d", filename, sample, rows1, rows2)
+	}
+	return strata, nil
+}
+
+// log10Permutations is the base 10 logarithm of the number of distinct splits the strata allow,
+// the product over the strata of choose(samples, condition 1 samples)
+func (s *sampleStrata) log10Permutations() float64 {
+	var total float64
+	for i, samples := range s.Samples {
+		n, k := float64(len(samples)), float64(s.C1[i])
+		a, _ := math.Lgamma(n + 1)
+		b, _ := math.Lgamma(k + 1)
+		c, _ := math.Lgamma(n - k + 1)
+		total += (a - b - c) / math.Ln10
+	}
+	return total
+}
+
+// describe lists every stratum with its number of samples in each condition
+func (s *sampleStrata) describe() string {
+	parts := make([]string, len(s.Labels))
+	for i, label := range s.Labels {
+		parts[i] = fmt.Sprintf("%s (%d+%d)", label, s.C1[i], len(s.Samples[i])-s.C1[i])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// randomStratifiedPermutation draws permutation k of the given seed under the strata: within every stratum
+// its samples are shuffled and as many as it has in condition 1 go to the permuted condition 1. The
+// returned indices, sorted, are the rows of rbind(datC1, datC2) that make up the permuted condition 1.
+func randomStratifiedPermutation(seed int64, k int, strata *sampleStrata) []int {
+	r := permutationRand(seed, k)
+	var permutation []int
+	for s, samples := range strata.Samples {
+		shuffled := append([]int{}, samples...)
+		for j := len(shuffled) - 1; j > 0; j-- {
+			l := r.Intn(j + 1)
+			shuffled[j], shuffled[l] = shuffled[l], shuffled[j]
+		}
+		permutation = append(permutation, shuffled[:strata.C1[s]]...)
+	}
+	sort.Ints(permutation)
+	return permutation
+}
+
+// drawPermutation draws permutation k of the given seed, the rows of rbind(datC1, datC2) that make up the
+// permuted condition 1: a free split of all samples, or a split within each stratum if strata is not nil
+func drawPermutation(seed int64, k, rows1, rows2 int, strata *sampleStrata) []int {
+	if strata != nil {
+		return randomStratifiedPermutation(seed, k, strata)
+	}
+	return randomPermutation(seed, k, rows1+rows2, rows1)
+}
+
+// strataFromFlags reads the strata given by the -metadata and -strata flags of a permutation command,
+// or returns nil if neither is set. It prints the strata and warns when they allow fewer distinct
+// permutations than requested.
+func strataFromFlags(metadataFile, strataColumns string, datC1, datC2 *labelledMatrix, permutations int) (*sampleStrata, error) {
+	if (metadataFile == "") != (strataColumns == "") {
+		return nil, fmt.Errorf("-metadata and -strata go together")
+	}
+	if metadataFile == "" {
+		return nil, nil
+	}
+
+	rows1, _ := datC1.Data.Dims()
+	rows2, _ := datC2.Data.Dims()
+	strata, err := readSampleStrata(metadataFile, strings.Split(strataColumns, ","), rows1, rows2)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Permuting within %d strata: %s\n", len(strata.Labels), strata.describe())
+	if distinct := strata.log10Permutations(); distinct < math.Log10(float64(permutations)) {
+		fmt.Printf("Warning: the strata allow only %.0f distinct permutations, fewer than the %d requested\n",
+			math.Pow(10, distinct), permutations)
+	}
+	return strata, nil
+}
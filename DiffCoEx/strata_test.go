@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSampleStrata(t *testing.T) {
+	// 3 samples in condition 1 followed by 3 in condition 2, tab separated
+	filename := filepath.Join(t.TempDir(), "samples.tsv")
+	metadata := "sample\tagent\ttime\n" +
+		"s1\tcontrol\t1\n" +
+		"s2\tdrug\t1\n" +
+		"s3\tcontrol\t1\n" +
+		"s4\tcontrol\t1\n" +
+		"s5\tdrug\t1\n" +
+		"s6\tdrug\t2\n"
+	if err := os.WriteFile(filename, []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	strata, err := readSampleStrata(filename, []string{"agent", " time"}, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strata.describe(); got != "control/1 (2+1), drug/1 (1+1), drug/2 (0+1)" {
+		t.Errorf("strata = %s", got)
+	}
+	if len(strata.Samples[0]) != 3 || strata.Samples[0][2] != 3 {
+		t.Errorf("control/1 samples = %v, want [0 2 3]", strata.Samples[0])
+	}
+
+	if _, err := readSampleStrata(filename, []string{"agent"}, 3, 4); err == nil {
+		t.Error("expected an error for a metadata file with too few samples")
+	}
+	if _, err := readSampleStrata(filename, []string{"dose"}, 3, 3); err == nil {
+		t.Error("expected an error for a missing column")
+	}
+}
+
+func TestRandomStratifiedPermutation(t *testing.T) {
+	strata := &sampleStrata{
+		Samples: [][]int{{0, 1, 5, 6}, {2, 3, 4, 7, 8, 9}},
+		C1:      []int{2, 3},
+	}
+	inStratum := map[int]int{0: 0, 1: 0, 5: 0, 6: 0, 2: 1, 3: 1, 4: 1, 7: 1, 8: 1, 9: 1}
+
+	for k := 0; k < 50; k++ {
+		permutation := randomStratifiedPermutation(9, k, strata)
+		counts := make([]int, 2)
+		for _, sample := range permutation {
+			counts[inStratum[sample]]++
+		}
+		if counts[0] != 2 || counts[1] != 3 {
+			t.Fatalf("permutation %d = %v takes %v samples per stratum, want [2 3]", k, permutation, counts)
+		}
+
+		again := randomStratifiedPermutation(9, k, strata)
+		for i := range permutation {
+			if permutation[i] != again[i] {
+				t.Fatalf("permutation %d is not reproducible: %v, then %v", k, permutation, again)
+			}
+		}
+	}
+}
+
+func TestModulePermutationTestWithinStrata(t *testing.T) {
+	// Strata that each hold a single condition leave nothing to shuffle: every permutation is the
+	// observed split, up to the scaling of the combined data, so every permutation is an exceedance
+	datC1, datC2, colorh1C1C2 := randomConditions(8)
+	strata := &sampleStrata{
+		Columns: []string{"condition"},
+		Samples: [][]int{{0, 1, 2, 3, 4, 5}, {6, 7, 8, 9, 10}},
+		C1:      []int{6, 0},
+	}
+	modules := []string{"blue", "red"}
+	result, err := modulePermutationTest(context.Background(), datC1, datC2, colorh1C1C2, modules,
+		permutationOptions{Permutations: 20, Seed: 1, Strata: strata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range modules {
+		for j := range modules {
+			for k, v := range result.Null[i][j] {
+				if v != result.Null[i][j][0] {
+					t.Fatalf("pair %d-%d permutation %d = %v, want %v", i, j, k, v, result.Null[i][j][0])
+				}
+			}
+		}
+	}
+	if got := result.seedComment(); got != "seed 1, 20 permutations, within strata of condition" {
+		t.Errorf("seedComment = %q", got)
+	}
+}
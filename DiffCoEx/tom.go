@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// tomSimilarity computes WGCNA's topological overlap matrix of a weighted adjacency matrix
+// (TOMDenom = "min"). For genes i and j with shared neighbourhood l_ij = sum_u a_iu*a_uj and
+// connectivities k_i = sum_u |a_iu|, the overlap is
+//
+//	unsigned: (l_ij + a_ij) / (min(k_i, k_j) + 1 - a_ij)
+//	signed:   |l_ij + a_ij| / (min(k_i, k_j) + 1 - |a_ij|)
+//
+// The diagonal of adj is ignored and the diagonal of the result is 1.
+// The O(n^3) shared neighbourhood step is split over the given number of goroutines
+// (all CPUs if workers < 1).
+func tomSimilarity(adj *mat.SymDense, signed bool, workers int) *mat.SymDense {
+	n := adj.SymmetricDim()
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	// Copy the adjacency into plain rows with a zero diagonal so that dot products can run on slices
+	rows := make([][]float64, n)
+	k := make([]float64, n)
+	for i := 0; i < n; i++ {
+		rows[i] = make([]float64, n)
+		for j := 0; j < n; j++ {
+			if i != j {
+				rows[i][j] = adj.At(i, j)
+				k[i] += math.Abs(rows[i][j])
+			}
+		}
+	}
+
+	tom := mat.NewSymDense(n, nil)
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each goroutine fills whole rows of the upper triangle, so no two goroutines write the same element
+			for i := range next {
+				tom.SetSym(i, i, 1)
+				for j := i + 1; j < n; j++ {
+					a := rows[i][j]
+					numerator := floats.Dot(rows[i], rows[j]) + a
+					if signed {
+						numerator = math.Abs(numerator)
+						a = math.Abs(a)
+					}
+					denominator := math.Min(k[i], k[j]) + 1 - a
+					tom.SetSym(i, j, numerator/denominator)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return tom
+}
+
+// tomDist returns the topological overlap dissimilarity 1 - TOM, as computed by WGCNA's TOMdist
+func tomDist(adj *mat.SymDense, signed bool, workers int) *mat.SymDense {
+	tom := tomSimilarity(adj, signed, workers)
+	n := tom.SymmetricDim()
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			tom.SetSym(i, j, 1-tom.At(i, j))
+		}
+	}
+	return tom
+}
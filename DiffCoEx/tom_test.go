@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// naiveTOM computes the topological overlap straight from its definition
+func naiveTOM(adj *mat.SymDense, signed bool) *mat.SymDense {
+	n := adj.SymmetricDim()
+	k := make([]float64, n)
+	for i := 0; i < n; i++ {
+		for u := 0; u < n; u++ {
+			if u != i {
+				k[i] += math.Abs(adj.At(i, u))
+			}
+		}
+	}
+
+	tom := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		tom.SetSym(i, i, 1)
+		for j := i + 1; j < n; j++ {
+			var l float64
+			for u := 0; u < n; u++ {
+				if u != i && u != j {
+					l += adj.At(i, u) * adj.At(u, j)
+				}
+			}
+			a := adj.At(i, j)
+			num := l + a
+			if signed {
+				num = math.Abs(num)
+				a = math.Abs(a)
+			}
+			tom.SetSym(i, j, num/(math.Min(k[i], k[j])+1-a))
+		}
+	}
+	return tom
+}
+
+func TestTOMSimilarityThreeGenes(t *testing.T) {
+	adj := mat.NewSymDense(3, []float64{
+		0, 0.5, 0.2,
+		0.5, 0, 0.4,
+		0.2, 0.4, 0,
+	})
+	tom := tomSimilarity(adj, false, 2)
+
+	// l_01 = 0.2*0.4, k_0 = 0.7, k_1 = 0.9
+	want := (0.08 + 0.5) / (0.7 + 1 - 0.5)
+	if math.Abs(tom.At(0, 1)-want) > 1e-12 {
+		t.Errorf("TOM[0][1] = %v, want %v", tom.At(0, 1), want)
+	}
+
+	dist := tomDist(adj, false, 2)
+	if dist.At(1, 1) != 0 || math.Abs(dist.At(0, 1)-(1-want)) > 1e-12 {
+		t.Errorf("TOMdist[0][1] = %v, want %v", dist.At(0, 1), 1-want)
+	}
+}
+
+func TestTOMSimilarityMatchesDefinition(t *testing.T) {
+	n := 7
+	adj := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			adj.SetSym(i, j, math.Sin(float64(3*i+5*j))*0.9)
+		}
+	}
+
+	for _, signed := range []bool{false, true} {
+		want := naiveTOM(adj, signed)
+		for _, workers := range []int{1, 3} {
+			got := tomSimilarity(adj, signed, workers)
+			if !mat.EqualApprox(got, want, 1e-12) {
+				t.Errorf("signed=%v workers=%d: TOM does not match the definition", signed, workers)
+			}
+		}
+	}
+}
+
+// tomDistFixture is a small adjacency matrix and its TOM dissimilarity, computed by hand (exact fractions,
+// rounded to 10 digits) from the formula of WGCNA's TOMdist: the diagonal of the adjacency is set to 0 and
+// the dissimilarity is 1 - (A %*% A + A) / (pmin(k_i, k_j) + 1 - A) with a zero diagonal. For genes 1 and
+// 2, (A %*% A)[1, 2] = 0.59, k = 1.8 and 2.2, so the dissimilarity is 1 - 1.39 / 2 = 0.305. The values
+// were not produced by running WGCNA; to compare them with it in R:
+//
+//	A <- matrix(c(0, .8, .3, .1, .6,  .8, 0, .5, .2, .7,  .3, .5, 0, .9, .4,
+//	              .1, .2, .9, 0, .25,  .6, .7, .4, .25, 0), 5, 5)
+//	print(WGCNA::TOMdist(A), digits = 10)
+var tomDistFixture = struct {
+	adj, dist []float64
+}{
+	adj: []float64{
+		0, 0.8, 0.3, 0.1, 0.6,
+		0.8, 0, 0.5, 0.2, 0.7,
+		0.3, 0.5, 0, 0.9, 0.4,
+		0.1, 0.2, 0.9, 0, 0.25,
+		0.6, 0.7, 0.4, 0.25, 0,
+	},
+	dist: []float64{
+		0, 0.3050000000, 0.5880000000, 0.7106382979, 0.4068181818,
+		0.3050000000, 0, 0.5384615385, 0.5977777778, 0.3644444444,
+		0.5880000000, 0.5384615385, 0, 0.2709677419, 0.5470588235,
+		0.7106382979, 0.5977777778, 0.2709677419, 0, 0.6318181818,
+		0.4068181818, 0.3644444444, 0.5470588235, 0.6318181818, 0,
+	},
+}
+
+func TestTOMDistByHand(t *testing.T) {
+	adj := mat.NewSymDense(5, tomDistFixture.adj)
+	want := mat.NewSymDense(5, tomDistFixture.dist)
+	for _, workers := range []int{1, 4} {
+		got := tomDist(adj, false, workers)
+		for i := 0; i < 5; i++ {
+			for j := 0; j < 5; j++ {
+				if math.Abs(got.At(i, j)-want.At(i, j)) > 1e-8 {
+					t.Errorf("workers=%d: TOMdist[%d][%d] = %.10f, want %.10f", workers, i, j, got.At(i, j), want.At(i, j))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/stat"
+)
+
+// standardize turns the observed statistic and its null distribution into z-scores against the mean
+// and standard deviation of the null distribution, so that tests with different null spreads can be
+// compared. A null distribution without spread gives 0 for equal values and +/-Inf otherwise.
+func standardize(observed float64, null []float64) (float64, []float64) {
+	mean, sd := stat.MeanStdDev(null, nil)
+	z := func(v float64) float64 {
+		if sd > 0 {
+			return (v - mean) / sd
+		}
+		switch {
+		case v > mean:
+			return math.Inf(1)
+		case v < mean:
+			return math.Inf(-1)
+		}
+		return 0
+	}
+
+	zNull := make([]float64, len(null))
+	for k, v := range null {
+		zNull[k] = z(v)
+	}
+	return z(observed), zNull
+}
+
+// maxTAdjust returns Westfall and Young's step-down maxT adjusted p-values (Westfall and Young 1993,
+// algorithm 4.1; Ge, Dudoit and Speed 2003). observed[t] is the statistic of test t and null[t][k] its
+// value on permutation k, larger values being more significant; every test must be evaluated on the
+// same permutations. Adjusted p-values use the (b+1)/(B+1) convention of the raw permutation p-values.
+func maxTAdjust(observed []float64, null [][]float64) []float64 {
+	m := len(observed)
+	adjusted := make([]float64, m)
+	if m == 0 {
+		return adjusted
+	}
+	permutations := len(null[0])
+
+	// Tests from the most to the least significant
+	order := make([]int, m)
+	for t := range order {
+		order[t] = t
+	}
+	sort.SliceStable(order, func(a, b int) bool { return observed[order[a]] > observed[order[b]] })
+
+	// For every permutation, u holds the running maximum over the tests from the least significant
+	// up to the current one; counts[r] counts the permutations where it reaches the observed statistic
+	counts := make([]int, m)
+	u := make([]float64, permutations)
+	for k := range u {
+		u[k] = math.Inf(-1)
+	}
+	for r := m - 1; r >= 0; r-- {
+		t := order[r]
+		for k := 0; k < permutations; k++ {
+			u[k] = math.Max(u[k], null[t][k])
+			if u[k] >= observed[t] {
+				counts[r]++
+			}
+		}
+	}
+
+	// Enforce monotonicity: a test is never more significant than a test with a larger statistic
+	running := 0.0
+	for r, t := range order {
+		p := float64(counts[r]+1) / float64(permutations+1)
+		running = math.Max(running, p)
+		adjusted[t] = running
+	}
+	return adjusted
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMaxTAdjust(t *testing.T) {
+	tests := []struct {
+		observed []float64
+		null     [][]float64
+		want     []float64
+	}{
+		// The less significant test is exceeded by the running maximum on 2 of 3 permutations
+		{[]float64{3, 1}, [][]float64{{0, 1, 2}, {2, 0, 0.5}}, []float64{0.25, 0.5}},
+		// The second test alone would get 1/4, but it cannot be more significant than the first
+		{[]float64{3, 2.9}, [][]float64{{2, 3.5, 1}, {0, 0, 0}}, []float64{0.5, 0.5}},
+		// Input order does not matter
+		{[]float64{2.9, 3}, [][]float64{{0, 0, 0}, {2, 3.5, 1}}, []float64{0.5, 0.5}},
+	}
+	for _, test := range tests {
+		got := maxTAdjust(test.observed, test.null)
+		for i := range test.want {
+			if math.Abs(got[i]-test.want[i]) > 1e-12 {
+				t.Errorf("maxTAdjust(%v, %v) = %v, want %v", test.observed, test.null, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStandardize(t *testing.T) {
+	z, zNull := standardize(5, []float64{1, 2, 3})
+	if z != 3 || zNull[0] != -1 || zNull[1] != 0 || zNull[2] != 1 {
+		t.Errorf("standardize = %v, %v, want 3, [-1 0 1]", z, zNull)
+	}
+	if z, _ := standardize(2, []float64{1, 1}); !math.IsInf(z, 1) {
+		t.Errorf("standardize without spread = %v, want +Inf", z)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/stat"
+)
+
+// compareWithNull compares the correlations within a module with the correlations of random gene sets of
+// the same size. It returns Welch's t statistic of the two samples and a two sided p-value from the
+// standard normal distribution. The p-value is only descriptive: the pairwise correlations of a set share
+// genes and are not independent, so pooling many of them does not make the normal approximation valid.
+// The driver tests modules with empiricalPValue instead. A null sample without spread gives t = 0 and p = 1.
+func compareWithNull(actualCorrs, nullCorrs []float64) (float64, float64) {
+	if len(actualCorrs) < 2 || len(nullCorrs) < 2 {
+		return 0, 1
+	}
+
+	meanActual, varActual := stat.MeanVariance(actualCorrs, nil)
+	meanNull, varNull := stat.MeanVariance(nullCorrs, nil)
+	if varNull == 0 {
+		return 0, 1
+	}
+
+	se := math.Sqrt(varActual/float64(len(actualCorrs)) + varNull/float64(len(nullCorrs)))
+	tstat := (meanActual - meanNull) / se
+	pval := 2 * (1 - normalCDF(math.Abs(tstat)))
+	return tstat, pval
+}
+
+// normalCDF returns the cumulative distribution function of the standard normal distribution
+func normalCDF(x float64) float64 {
+	return 0.5 * (1 + math.Erf(x/math.Sqrt(2)))
+}
+
+// standardizeGene centers an expression profile and scales it to unit length, so that the Pearson
+// correlation of two standardized profiles is their dot product. A constant profile becomes all zeros.
+func standardizeGene(values []float64) []float64 {
+	z := make([]float64, len(values))
+	mean := stat.Mean(values, nil)
+	for i, v := range values {
+		z[i] = v - mean
+	}
+	if norm := floats.Norm(z, 2); norm > 0 {
+		floats.Scale(1/norm, z)
+	}
+	return z
+}
+
+// withinCorrelations returns the Pearson correlation of every pair of the given standardized profiles
+func withinCorrelations(profiles [][]float64) []float64 {
+	var correlations []float64
+	for i := 0; i < len(profiles)-1; i++ {
+		for j := i + 1; j < len(profiles); j++ {
+			correlations = append(correlations, floats.Dot(profiles[i], profiles[j]))
+		}
+	}
+	return correlations
+}
+
+// nullCorrelations pools the within-set correlations of sets random gene sets of the given size, drawn
+// without replacement from all standardized profiles. The correlations of each set are consecutive.
+func nullCorrelations(profiles [][]float64, size, sets int, rng *rand.Rand) []float64 {
+	indices := make([]int, len(profiles))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	var correlations []float64
+	set := make([][]float64, size)
+	for s := 0; s < sets; s++ {
+		// Partial Fisher-Yates shuffle: the first size entries are a sample without replacement
+		for i := 0; i < size; i++ {
+			j := i + rng.Intn(len(indices)-i)
+			indices[i], indices[j] = indices[j], indices[i]
+			set[i] = profiles[indices[i]]
+		}
+		correlations = append(correlations, withinCorrelations(set)...)
+	}
+	return correlations
+}
+
+// nullMeans returns the mean within-set correlation of each of sets random gene sets of the given size,
+// the null distribution of the mean correlation of a module of that size
+func nullMeans(profiles [][]float64, size, sets int, rng *rand.Rand) []float64 {
+	correlations := nullCorrelations(profiles, size, sets, rng)
+	pairs := size * (size - 1) / 2
+	means := make([]float64, sets)
+	for s := range means {
+		means[s] = stat.Mean(correlations[s*pairs:(s+1)*pairs], nil)
+	}
+	return means
+}
+
+// exceedances counts the null values at least as large as the observed statistic
+func exceedances(observed float64, null []float64) int {
+	var b int
+	for _, v := range null {
+		if v >= observed {
+			b++
+		}
+	}
+	return b
+}
+
+// empiricalPValue is the one sided p-value (b+1)/(B+1) of an observed statistic against B null values,
+// b of which are at least as large
+func empiricalPValue(observed float64, null []float64) float64 {
+	return float64(exceedances(observed, null)+1) / float64(len(null)+1)
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"bufio"
 	"math"
+	"math/rand"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+
+	"gonum.org/v1/gonum/stat"
 )
 
 func readInputFile(filename string) ([]float64, []float64, error) {
@@ -105,3 +109,99 @@ func TestCompareWithNullFromFile(t *testing.T) {
 		})
 	}
 }
+
+// noiseProfiles returns n standardized random profiles of the given number of samples
+func noiseProfiles(rng *rand.Rand, n, samples int) [][]float64 {
+	profiles := make([][]float64, n)
+	for i := range profiles {
+		values := make([]float64, samples)
+		for j := range values {
+			values[j] = rng.NormFloat64()
+		}
+		profiles[i] = standardizeGene(values)
+	}
+	return profiles
+}
+
+func TestWithinCorrelations(t *testing.T) {
+	x := []float64{1, 2, 3, 4, 5}
+	y := []float64{2, 1, 4, 3, 6}
+	z := []float64{5, 4, 3, 2, 1}
+	correlations := withinCorrelations([][]float64{standardizeGene(x), standardizeGene(y), standardizeGene(z)})
+	want := []float64{stat.Correlation(x, y, nil), -1, stat.Correlation(y, z, nil)}
+	if len(correlations) != len(want) {
+		t.Fatalf("got %d correlations, want %d", len(correlations), len(want))
+	}
+	for i := range want {
+		if math.Abs(correlations[i]-want[i]) > 1e-12 {
+			t.Errorf("correlation %d = %v, want %v", i, correlations[i], want[i])
+		}
+	}
+
+	// A constant profile standardizes to zeros and correlates 0 with everything
+	if c := withinCorrelations([][]float64{standardizeGene([]float64{2, 2, 2}), standardizeGene(x[:3])}); c[0] != 0 {
+		t.Errorf("correlation with a constant profile = %v, want 0", c[0])
+	}
+}
+
+func TestNullCorrelations(t *testing.T) {
+	profiles := noiseProfiles(rand.New(rand.NewSource(1)), 6, 10)
+
+	pooled := nullCorrelations(profiles, 3, 4, rand.New(rand.NewSource(2)))
+	if len(pooled) != 4*3 {
+		t.Fatalf("got %d correlations, want 4 sets of 3 pairs", len(pooled))
+	}
+	again := nullCorrelations(profiles, 3, 4, rand.New(rand.NewSource(2)))
+	for i := range pooled {
+		if pooled[i] != again[i] {
+			t.Fatalf("the same seed gave different correlations")
+		}
+	}
+
+	// A set of every gene holds every pair, so each set gives the within correlations of all genes
+	all := withinCorrelations(profiles)
+	sort.Float64s(all)
+	full := nullCorrelations(profiles, len(profiles), 2, rand.New(rand.NewSource(3)))
+	for s := 0; s < 2; s++ {
+		set := append([]float64{}, full[s*len(all):(s+1)*len(all)]...)
+		sort.Float64s(set)
+		for i := range all {
+			if math.Abs(set[i]-all[i]) > 1e-12 {
+				t.Fatalf("set %d has correlations %v, want %v", s, set, all)
+			}
+		}
+	}
+}
+
+func TestNullMeans(t *testing.T) {
+	profiles := noiseProfiles(rand.New(rand.NewSource(1)), 8, 10)
+	means := nullMeans(profiles, 4, 5, rand.New(rand.NewSource(7)))
+	pooled := nullCorrelations(profiles, 4, 5, rand.New(rand.NewSource(7)))
+	if len(means) != 5 {
+		t.Fatalf("got %d means, want 5", len(means))
+	}
+	for s, mean := range means {
+		var sum float64
+		for _, c := range pooled[s*6 : (s+1)*6] {
+			sum += c
+		}
+		if math.Abs(mean-sum/6) > 1e-12 {
+			t.Errorf("mean of set %d = %v, want %v", s, mean, sum/6)
+		}
+	}
+}
+
+func TestEmpiricalPValue(t *testing.T) {
+	null := []float64{0.1, 0.2, 0.3, 0.4}
+	for _, tt := range []struct {
+		observed, want float64
+	}{
+		{0.5, 1.0 / 5},
+		{0.3, 3.0 / 5},
+		{0.0, 5.0 / 5},
+	} {
+		if got := empiricalPValue(tt.observed, null); got != tt.want {
+			t.Errorf("empiricalPValue(%v) = %v, want %v", tt.observed, got, tt.want)
+		}
+	}
+}
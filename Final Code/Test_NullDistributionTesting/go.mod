@@ -0,0 +1,10 @@
+module github.com/kcw27/PFS_Group_Project/nulltest
+
+go 1.24.0
+
+require (
+	github.com/kcw27/PFS_Group_Project v0.0.0
+	gonum.org/v1/gonum v0.17.0
+)
+
+replace github.com/kcw27/PFS_Group_Project => ../../
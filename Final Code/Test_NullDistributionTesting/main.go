@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kcw27/PFS_Group_Project/genecolor"
+	"github.com/kcw27/PFS_Group_Project/multipletesting"
+	"gonum.org/v1/gonum/stat"
+)
+
+// nullTest is the comparison of the mean correlation of one module with the mean correlations of
+// random gene sets of the same size
+type nullTest struct {
+	Module     string
+	Size       int
+	MeanActual float64
+	MeanNull   float64
+	// Exceedances is the number of random sets whose mean correlation is at least the module's
+	Exceedances    int
+	PValue         float64
+	AdjustedPValue float64
+}
+
+func main() {
+	exprFile := flag.String("expr", "", "expression file, one gene per row: gene ID then one value per sample (output of preprocess)")
+	modulesFile := flag.String("modules", "", "module file: gene and module per line, comma or space separated")
+	sets := flag.Int("sets", 100, "random gene sets drawn per module size")
+	seed := flag.Int64("seed", -1, "random seed (negative = seed from the clock)")
+	adjust := flag.String("adjust", "BH", "multiple testing correction of the module p-values: "+strings.Join(multipletesting.Methods, ", "))
+	out := flag.String("out", "null_tests.tsv", "output table")
+	flag.Parse()
+
+	if *exprFile == "" || *modulesFile == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *seed < 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	geneIDs, profiles, err := loadExpression(*exprFile)
+	if err != nil {
+		log.Fatalf("Error loading expression data: %v", err)
+	}
+	moduleMap, err := genecolor.ReadFile(*modulesFile)
+	if err != nil {
+		log.Fatalf("Error loading modules: %v", err)
+	}
+
+	// Standardize every gene once; correlations are then dot products
+	index := make(map[string]int, len(geneIDs))
+	for i, gene := range geneIDs {
+		index[gene] = i
+		profiles[i] = standardizeGene(profiles[i])
+	}
+
+	members := make(map[string][]int)
+	for gene, module := range moduleMap {
+		if i, ok := index[gene]; ok && module != "grey" {
+			members[module] = append(members[module], i)
+		}
+	}
+	results := testModules(profiles, members, *sets, rand.New(rand.NewSource(*seed)))
+
+	pvals := make([]float64, len(results))
+	for i, r := range results {
+		pvals[i] = r.PValue
+	}
+	adjusted, err := multipletesting.Adjust(pvals, *adjust)
+	if err != nil {
+		log.Fatalf("Error adjusting p-values: %v", err)
+	}
+	for i := range results {
+		results[i].AdjustedPValue = adjusted[i]
+	}
+
+	if err := saveNullTests(results, *adjust, *out); err != nil {
+		log.Fatalf("Error saving results: %v", err)
+	}
+	fmt.Printf("Tested %d modules against %d random gene sets per size (seed %d). Results saved to %s\n",
+		len(results), *sets, *seed, *out)
+}
+
+// testModules tests every module of at least 3 genes, in alphabetical order. members holds the rows of
+// profiles (standardized) of each module's genes. The mean correlation of a module is compared with the
+// mean correlations of sets random gene sets of the same size, which modules of the same size share,
+// giving the p-value (b+1)/(sets+1) of b random sets at least as correlated.
+func testModules(profiles [][]float64, members map[string][]int, sets int, rng *rand.Rand) []nullTest {
+	var modules []string
+	for module, genes := range members {
+		if len(genes) >= 3 {
+			modules = append(modules, module)
+		}
+	}
+	sort.Strings(modules)
+
+	nulls := make(map[int][]float64)
+	var results []nullTest
+	for _, module := range modules {
+		genes := append([]int{}, members[module]...)
+		sort.Ints(genes)
+		profilesOfModule := make([][]float64, len(genes))
+		for i, g := range genes {
+			profilesOfModule[i] = profiles[g]
+		}
+
+		null, ok := nulls[len(genes)]
+		if !ok {
+			null = nullMeans(profiles, len(genes), sets, rng)
+			nulls[len(genes)] = null
+		}
+
+		actual := stat.Mean(withinCorrelations(profilesOfModule), nil)
+		results = append(results, nullTest{
+			Module:      module,
+			Size:        len(genes),
+			MeanActual:  actual,
+			MeanNull:    stat.Mean(null, nil),
+			Exceedances: exceedances(actual, null),
+			PValue:      empiricalPValue(actual, null),
+		})
+	}
+	return results
+}
+
+// loadExpression reads a gene by sample CSV file. A first row whose second field is not a number is
+// taken as a header and skipped, so files with and without sample names both work.
+func loadExpression(filename string) ([]string, [][]float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	var geneIDs []string
+	var profiles [][]float64
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(record) < 2 {
+			return nil, nil, fmt.Errorf("row %d has no expression values", len(geneIDs)+1)
+		}
+
+		values := make([]float64, len(record)-1)
+		for j, field := range record[1:] {
+			values[j], err = strconv.ParseFloat(field, 64)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if first {
+				continue
+			}
+			return nil, nil, fmt.Errorf("gene %s: %v", record[0], err)
+		}
+		geneIDs = append(geneIDs, record[0])
+		profiles = append(profiles, values)
+	}
+	return geneIDs, profiles, nil
+}
+
+// saveNullTests writes one tab separated row per module; the adjusted p-value column is named after
+// the correction
+func saveNullTests(results []nullTest, method, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "module\tsize\tmean.corr\tmean.null.corr\tnull.above\tp\tp.%s\n", method)
+	for _, r := range results {
+		fmt.Fprintf(writer, "%s\t%d\t%g\t%g\t%d\t%g\t%g\n", r.Module, r.Size, r.MeanActual, r.MeanNull,
+			r.Exceedances, r.PValue, r.AdjustedPValue)
+	}
+	return writer.Flush()
+}
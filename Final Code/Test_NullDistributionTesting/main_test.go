@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTestModulesFindsCorrelatedModule(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	samples := 12
+	profiles := noiseProfiles(rng, 40, samples)
+
+	// Genes 0-5 share one signal; genes 10-15 stay independent noise
+	signal := make([]float64, samples)
+	for j := range signal {
+		signal[j] = rng.NormFloat64()
+	}
+	for g := 0; g < 6; g++ {
+		values := make([]float64, samples)
+		for j := range values {
+			values[j] = signal[j] + 0.3*rng.NormFloat64()
+		}
+		profiles[g] = standardizeGene(values)
+	}
+
+	members := map[string][]int{
+		"blue":  {5, 4, 3, 2, 1, 0},
+		"brown": {10, 11, 12, 13, 14, 15},
+		"tiny":  {20, 21},
+	}
+	sets := 199
+	results := testModules(profiles, members, sets, rand.New(rand.NewSource(2)))
+	if len(results) != 2 || results[0].Module != "blue" || results[1].Module != "brown" {
+		t.Fatalf("tested %v, want blue and brown (modules under 3 genes are skipped)", results)
+	}
+
+	blue, brown := results[0], results[1]
+	if blue.Exceedances != 0 || blue.PValue != 1.0/float64(sets+1) {
+		t.Errorf("blue: %d random sets above, p = %v; want 0 and %v", blue.Exceedances, blue.PValue, 1.0/float64(sets+1))
+	}
+	if brown.PValue < 0.05 {
+		t.Errorf("brown: p = %v for a module of independent genes", brown.PValue)
+	}
+	for _, r := range results {
+		if want := float64(r.Exceedances+1) / float64(sets+1); r.PValue != want {
+			t.Errorf("%s: p = %v, want (b+1)/(B+1) = %v", r.Module, r.PValue, want)
+		}
+	}
+	if blue.MeanNull != brown.MeanNull {
+		t.Errorf("modules of the same size should share the null: %v, %v", blue.MeanNull, brown.MeanNull)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/kcw27/PFS_Group_Project/finalcode
+
+go 1.24.0
+
+require gonum.org/v1/gonum v0.17.0
@@ -0,0 +1,75 @@
+// Package genecolor reads and writes module files, which assign every gene a module color (or a cluster
+// number). It is shared by the DiffCoEx tool and the null distribution test.
+package genecolor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadFile reads a module file and returns the module of every gene
+func ReadFile(filename string) (map[string]string, error) {
+	// Open the file
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Initialize the map to store gene-color pairs
+	geneColorMap := make(map[string]string)
+
+	// Create a scanner to read through the file line by line
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Split each line by space, assuming that the first column is the gene and the second is the color.
+		// Lines with commas are read as CSV, so the Gene,Cluster files written by clustering.R also work.
+		parts := strings.Fields(line)
+		if strings.Contains(line, ",") {
+			parts = strings.Split(line, ",")
+			for i := range parts {
+				parts[i] = strings.Trim(strings.TrimSpace(parts[i]), "\"")
+			}
+		}
+		if len(parts) == 2 && (strings.EqualFold(parts[1], "Cluster") || strings.EqualFold(parts[1], "Module")) {
+			// Header written by write.csv
+			continue
+		}
+		if len(parts) == 2 {
+			gene := parts[0]
+			color := parts[1]
+			// Add to the map
+			geneColorMap[gene] = color
+		} else {
+			// Handle unexpected line format
+			fmt.Printf("Skipping invalid line: %s\n", line)
+		}
+	}
+
+	// Check for errors during scanning
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return geneColorMap, nil
+}
+
+// WriteFile writes one "gene color" line per gene, the format ReadFile reads
+func WriteFile(filename string, geneIDs, colors []string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for i, gene := range geneIDs {
+		if _, err := fmt.Fprintf(writer, "%s %s\n", gene, colors[i]); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,36 @@
+package genecolor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "modules.txt")
+	if err := WriteFile(path, []string{"1367452_at", "1367453_at"}, []string{"blue", "grey"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["1367452_at"] != "blue" || got["1367453_at"] != "grey" {
+		t.Errorf("ReadFile() = %v, want 1367452_at blue and 1367453_at grey", got)
+	}
+}
+
+func TestReadFileCSV(t *testing.T) {
+	// Gene,Cluster file as written by write.csv in clustering.R
+	path := filepath.Join(t.TempDir(), "clusters.csv")
+	if err := os.WriteFile(path, []byte("\"Gene\",\"Cluster\"\n\"1367452_at\",3\n\"1367453_at\", 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["1367452_at"] != "3" || got["1367453_at"] != "1" {
+		t.Errorf("ReadFile() = %v, want 1367452_at 3 and 1367453_at 1", got)
+	}
+}
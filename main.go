@@ -2,44 +2,179 @@ package main
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"math"
 	"gonum.org/v1/gonum/stat"
+	"gonum.org/v1/gonum/stat/distuv"
+	"github.com/kcw27/PFS_Group_Project/multipletesting"
 )
 
 type ModuleStats struct {
 	Name string
-	TStatistic float64
+	Condition1 string
+	Condition2 string
+	Statistic float64
 	PValue float64
+	AdjustedPValue float64
 	Size int
 }
 
+// condition is the expression data of one group of samples
+type condition struct {
+	Name string
+	Data map[string][]float64
+	Samples int
+}
+
+// conditionFiles collects the -condition flags, "name=file" or just "file" (named after the file)
+type conditionFiles []string
+
+func (c *conditionFiles) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *conditionFiles) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// options are the command line settings of the module comparison
+type options struct {
+	ModulesFile string
+	Conditions conditionFiles
+	Adjust string
+	Test string
+	Balance int
+	Seed int64
+}
+
+// parseOptions reads the command line arguments, filling in the Golub AML and ALL files when no condition
+// is given
+func parseOptions(args []string) (*options, error) {
+	opts := &options{}
+	fs := flag.NewFlagSet("module comparison", flag.ContinueOnError)
+	fs.StringVar(&opts.ModulesFile, "modules", "data/golub/golub_diffcoex.csv", "module file: CSV with a header, gene then module")
+	fs.Var(&opts.Conditions, "condition", "condition expression file, as name=file or file; repeat for every condition (default: the Golub AML and ALL samples)")
+	fs.StringVar(&opts.Adjust, "adjust", "BH", "multiple testing correction of the module p-values: "+strings.Join(multipletesting.Methods, ", "))
+	fs.StringVar(&opts.Test, "test", "welch", "test comparing the correlations of the two conditions: welch, mannwhitney or ks")
+	fs.IntVar(&opts.Balance, "balance", 0, "number of balanced draws: subsample both conditions of a comparison to the smaller size and report the median statistic and p-value over the draws, as a description only (0 = use every sample and test)")
+	fs.Int64Var(&opts.Seed, "seed", 1, "random seed for the balanced draws")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if _, ok := testStatistics[opts.Test]; !ok {
+		return nil, fmt.Errorf("unknown test %q: use welch, mannwhitney or ks", opts.Test)
+	}
+	if opts.Balance < 0 {
+		return nil, fmt.Errorf("-balance must be at least 0")
+	}
+	if len(opts.Conditions) == 0 {
+		opts.Conditions = conditionFiles{"AML=data/golub/aml_samples.csv", "ALL=data/golub/all_samples.csv"}
+	}
+	if len(opts.Conditions) < 2 {
+		return nil, fmt.Errorf("at least two conditions are needed")
+	}
+	return opts, nil
+}
+
+// conditionName splits a -condition value into the condition name and the file; a plain file is named
+// after its base name without extension
+func conditionName(value string) (name, path string) {
+	name, path, found := strings.Cut(value, "=")
+	if !found {
+		return strings.TrimSuffix(filepath.Base(value), filepath.Ext(value)), value
+	}
+	return name, path
+}
+
 func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	statisticName := testStatistics[opts.Test]
+
 	// Load module assignments
-	moduleMap, err := loadModules("data/golub/golub_diffcoex.csv")
+	moduleMap, err := loadModules(opts.ModulesFile)
 	if err != nil {
 		log.Fatal("Error loading modules:", err)
 	}
 
 	// Load expression data
-	amlData, err := loadExpressionData("data/golub/aml_samples.csv")
-	if err != nil {
-		log.Fatal("Error loading AML data:", err)
+	conditions := make([]condition, len(opts.Conditions))
+	for i, file := range opts.Conditions {
+		name, path := conditionName(file)
+		data, err := loadExpressionData(path)
+		if err != nil {
+			log.Fatalf("Error loading %s data: %v", name, err)
+		}
+		conditions[i] = condition{Name: name, Data: data, Samples: sampleCount(data)}
+		fmt.Fprintf(os.Stderr, "%s: %d genes, %d samples\n", name, len(data), conditions[i].Samples)
+	}
+
+	// Analyze each module in every pair of conditions
+	var modules []string
+	for module := range getUniqueModules(moduleMap) {
+		modules = append(modules, module)
 	}
+	sort.Strings(modules)
 
-	allData, err := loadExpressionData("data/golub/all_samples.csv")
+	rng := rand.New(rand.NewSource(opts.Seed))
+	var results []ModuleStats
+	var pvals []float64
+	for a := 0; a < len(conditions)-1; a++ {
+		for b := a + 1; b < len(conditions); b++ {
+			for _, module := range modules {
+				var stats ModuleStats
+				if opts.Balance > 0 {
+					stats = analyzeModuleBalanced(module, moduleMap, conditions[a], conditions[b], opts.Test, opts.Balance, rng)
+				} else {
+					stats = analyzeModule(module, moduleMap, conditions[a].Data, conditions[b].Data, nil, nil, opts.Test)
+				}
+				stats.Condition1, stats.Condition2 = conditions[a].Name, conditions[b].Name
+				results = append(results, stats)
+				pvals = append(pvals, stats.PValue)
+			}
+		}
+	}
+
+	// The median p-value of the balanced draws is not a p-value itself, so it is reported as a
+	// description and left out of the multiple testing correction
+	if opts.Balance > 0 {
+		fmt.Fprintf(os.Stderr, "Median over %d balanced draws (seed %d); the median p-values are descriptive and not adjusted\n",
+			opts.Balance, opts.Seed)
+		fmt.Printf("Module\tConditions\tSize\tMedian %s\tMedian P-Value\n", statisticName)
+		for _, stats := range results {
+			fmt.Printf("%s\t%s vs %s\t%d\t%f\t%f\n", stats.Name, stats.Condition1, stats.Condition2, stats.Size,
+				stats.Statistic, stats.PValue)
+		}
+		return
+	}
+
+	// Correct the p-values for testing every module in every pair of conditions
+	adjusted, err := multipletesting.Adjust(pvals, opts.Adjust)
 	if err != nil {
-		log.Fatal("Error loading ALL data:", err)
+		log.Fatal("Error adjusting p-values:", err)
 	}
 
-	// Analyze each module
-	fmt.Printf("Module\tSize\tT-Statistic\tP-Value\n")
-	for module := range getUniqueModules(moduleMap) {
-		stats := analyzeModule(module, moduleMap, amlData, allData)
-		fmt.Printf("%s\t%d\t%f\t%f\n", stats.Name, stats.Size, stats.TStatistic, stats.PValue)
+	fmt.Printf("Module\tConditions\tSize\t%s\tP-Value\tP-Value (%s)\n", statisticName, opts.Adjust)
+	for i, stats := range results {
+		stats.AdjustedPValue = adjusted[i]
+		fmt.Printf("%s\t%s vs %s\t%d\t%f\t%f\t%f\n", stats.Name, stats.Condition1, stats.Condition2, stats.Size,
+			stats.Statistic, stats.PValue, stats.AdjustedPValue)
 	}
 }
 
@@ -75,41 +210,87 @@ func loadExpressionData(filename string) (map[string][]float64, error) {
 	}
 	defer file.Close()
 
+	// Every row must have as many fields as the first one, so that sample i is column i of every gene
 	reader := csv.NewReader(file)
 	data := make(map[string][]float64)
 	
-	// Skip header if it exists
-	_, err = reader.Read()
-	if err != nil {
-		return nil, err
-	}
-	
-	for {
+	for first := true; ; first = false {
 		record, err := reader.Read()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
+		
+		// Skip a header row (no numeric values); files written by saveToCSV have none
+		if first && isHeader(record) {
+			continue
+		}
 		
 		geneName := record[0]
-		values := make([]float64, 0)
+		values := make([]float64, len(record)-1)
 		
-		// Convert string values to float64, starting from column 1
-		for _, val := range record[1:] {
+		// Convert string values to float64, starting from column 1. Missing values are kept as NaN
+		// so that the samples stay aligned.
+		for i, val := range record[1:] {
+			if isMissing(val) {
+				values[i] = math.NaN()
+				continue
+			}
 			f, err := strconv.ParseFloat(val, 64)
 			if err != nil {
-				continue
+				return nil, fmt.Errorf("gene %s, column %d: %q is not a number", geneName, i+2, val)
 			}
-			values = append(values, f)
+			values[i] = f
 		}
 		
-		if len(values) > 0 {
-			data[geneName] = values
-		}
+		data[geneName] = values
 	}
 	return data, nil
 }
 
-func analyzeModule(moduleName string, moduleMap map[string]string, amlData, allData map[string][]float64) ModuleStats {
+// isMissing reports whether an expression value is missing: empty, or NA as R writes it
+func isMissing(field string) bool {
+	switch strings.TrimSpace(field) {
+	case "", "NA", "NaN":
+		return true
+	}
+	return false
+}
+
+// isHeader reports whether none of the fields after the first one is a number or a missing value
+func isHeader(record []string) bool {
+	for _, field := range record[1:] {
+		if _, err := strconv.ParseFloat(field, 64); err == nil || isMissing(field) {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleCount returns the number of samples of a condition. loadExpressionData gives every gene one
+// value per sample, so any gene will do.
+func sampleCount(data map[string][]float64) int {
+	for _, values := range data {
+		return len(values)
+	}
+	return 0
+}
+
+// testStatistics names the statistic reported by each test of analyzeModule
+var testStatistics = map[string]string{
+	"welch":       "T-Statistic",
+	"mannwhitney": "U-Statistic",
+	"ks":          "D-Statistic",
+}
+
+// analyzeModule compares the within-module correlations of the two conditions with the given test:
+// "welch" (Welch's t-test), "mannwhitney" (Mann-Whitney U) or "ks" (two sample Kolmogorov-Smirnov).
+// samples1 and samples2 select the samples of each condition used for the correlations (nil = all).
+// The tests treat the correlations as independent observations, but correlations that share a gene are
+// not, so the p-values rank modules rather than give calibrated error rates.
+func analyzeModule(moduleName string, moduleMap map[string]string, data1, data2 map[string][]float64, samples1, samples2 []int, test string) ModuleStats {
 	// Get genes in this module
 	var moduleGenes []string
 	for gene, module := range moduleMap {
@@ -119,21 +300,76 @@ func analyzeModule(moduleName string, moduleMap map[string]string, amlData, allD
 	}
 
 	// Get correlation values for both conditions
-	amlCorrs := getModuleCorrelations(moduleGenes, amlData)
-	allCorrs := getModuleCorrelations(moduleGenes, allData)
+	corrs1 := getModuleCorrelations(moduleGenes, data1, samples1)
+	corrs2 := getModuleCorrelations(moduleGenes, data2, samples2)
 
-	// Calculate t-statistic and p-value manually
-	tstat, pval := calculateTTest(amlCorrs, allCorrs)
+	// Calculate the test statistic and p-value manually
+	var statistic, pval float64
+	switch test {
+	case "mannwhitney":
+		statistic, pval = mannWhitneyU(corrs1, corrs2)
+	case "ks":
+		statistic, pval = kolmogorovSmirnov(corrs1, corrs2)
+	default:
+		statistic, pval = calculateTTest(corrs1, corrs2)
+	}
 
 	return ModuleStats{
 		Name: moduleName,
-		TStatistic: tstat,
+		Statistic: statistic,
 		PValue: pval,
 		Size: len(moduleGenes),
 	}
 }
 
-func getModuleCorrelations(genes []string, expressionData map[string][]float64) []float64 {
+// balancedSamples draws size samples out of each condition, without replacement
+func balancedSamples(samples1, samples2, size int, rng *rand.Rand) ([]int, []int) {
+	return rng.Perm(samples1)[:size], rng.Perm(samples2)[:size]
+}
+
+// analyzeModuleBalanced repeats analyzeModule on draws random draws of equal size from both conditions, as many
+// samples as the smaller condition has, and returns the median statistic and p-value over the draws. The draws
+// overlap, so the median p-value describes how the test behaves on balanced data but is not a p-value.
+func analyzeModuleBalanced(moduleName string, moduleMap map[string]string, c1, c2 condition, test string, draws int, rng *rand.Rand) ModuleStats {
+	size := c1.Samples
+	if c2.Samples < size {
+		size = c2.Samples
+	}
+
+	statistics := make([]float64, draws)
+	pvals := make([]float64, draws)
+	var stats ModuleStats
+	for r := 0; r < draws; r++ {
+		samples1, samples2 := balancedSamples(c1.Samples, c2.Samples, size, rng)
+		stats = analyzeModule(moduleName, moduleMap, c1.Data, c2.Data, samples1, samples2, test)
+		statistics[r] = stats.Statistic
+		pvals[r] = stats.PValue
+	}
+	stats.Statistic = median(statistics)
+	stats.PValue = median(pvals)
+	return stats
+}
+
+// median returns the median of the values, NaN if any of them is NaN
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	for _, v := range sorted {
+		if math.IsNaN(v) {
+			return math.NaN()
+		}
+	}
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// getModuleCorrelations returns the Pearson correlation of every pair of module genes found in the
+// expression data, over the given samples (nil = every sample). Samples missing (NaN) in either gene
+// are left out of that pair only, like cor(use = "pairwise.complete.obs") in R.
+func getModuleCorrelations(genes []string, expressionData map[string][]float64, samples []int) []float64 {
 	var correlations []float64
 
 	// Get all pairwise correlations
@@ -147,13 +383,11 @@ func getModuleCorrelations(genes []string, expressionData map[string][]float64)
 			expr2, ok2 := expressionData[gene2]
 
 			if ok1 && ok2 {
-				// For ALL data, limit to first 11 samples
-				if len(expr1) > 11 {
-					expr1 = expr1[:11]
-				}
-				if len(expr2) > 11 {
-					expr2 = expr2[:11]
+				if samples != nil {
+					expr1 = selectSamples(expr1, samples)
+					expr2 = selectSamples(expr2, samples)
 				}
+				expr1, expr2 = completePairs(expr1, expr2)
 
 				// Calculate correlation
 				corr := stat.Correlation(expr1, expr2, nil)
@@ -165,7 +399,37 @@ func getModuleCorrelations(genes []string, expressionData map[string][]float64)
 	return correlations
 }
 
+// completePairs returns the values of the samples where neither x nor y is NaN
+func completePairs(x, y []float64) ([]float64, []float64) {
+	var cx, cy []float64
+	for i := range x {
+		if !math.IsNaN(x[i]) && !math.IsNaN(y[i]) {
+			cx = append(cx, x[i])
+			cy = append(cy, y[i])
+		}
+	}
+	return cx, cy
+}
+
+// selectSamples returns the values of the given samples
+func selectSamples(values []float64, samples []int) []float64 {
+	selected := make([]float64, len(samples))
+	for i, s := range samples {
+		selected[i] = values[s]
+	}
+	return selected
+}
+
+// calculateTTest performs Welch's t-test. The p-value comes from the Student t distribution with the
+// Welch-Satterthwaite degrees of freedom. That is exact only for independent normal samples; the
+// pairwise correlations of a module are not independent, so even with the t distribution the p-value
+// is not calibrated. NaN values are dropped first, as t.test drops NA.
 func calculateTTest(x, y []float64) (tstat, pval float64) {
+	x, y = dropNaN(x), dropNaN(y)
+	if len(x) < 2 || len(y) < 2 {
+		return math.NaN(), math.NaN()
+	}
+
 	meanX := stat.Mean(x, nil)
 	meanY := stat.Mean(y, nil)
 	varX := stat.Variance(x, nil)
@@ -174,19 +438,204 @@ func calculateTTest(x, y []float64) (tstat, pval float64) {
 	nx := float64(len(x))
 	ny := float64(len(y))
 	
-	// Calculate pooled standard error
+	// Calculate unpooled standard error
 	se := math.Sqrt((varX/nx) + (varY/ny))
 	
 	// Calculate t-statistic
 	tstat = (meanX - meanY) / se
 	
-	// Calculate approximate p-value using normal distribution
-	z := math.Abs(tstat)
-	pval = 2 * (1 - normalCDF(z))
+	// Two sided p-value from the Student t distribution
+	t := distuv.StudentsT{Mu: 0, Sigma: 1, Nu: welchDF(x, y)}
+	pval = 2 * t.Survival(math.Abs(tstat))
 	
 	return tstat, pval
 }
 
+// welchDF returns the Welch-Satterthwaite degrees of freedom of Welch's t-test
+func welchDF(x, y []float64) float64 {
+	vx := stat.Variance(x, nil) / float64(len(x))
+	vy := stat.Variance(y, nil) / float64(len(y))
+	return (vx + vy) * (vx + vy) / (vx*vx/float64(len(x)-1) + vy*vy/float64(len(y)-1))
+}
+
+// mannWhitneyU performs the two sided Mann-Whitney U (Wilcoxon rank sum) test. U counts the pairs with
+// x above y (ties count one half); the p-value uses the normal approximation with tie and continuity
+// corrections, as R's wilcox.test does when it cannot compute the exact distribution. NaN values are
+// dropped before ranking, as wilcox.test drops NA.
+func mannWhitneyU(x, y []float64) (u, pval float64) {
+	x, y = dropNaN(x), dropNaN(y)
+	nx := float64(len(x))
+	ny := float64(len(y))
+	if len(x) == 0 || len(y) == 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	// Rank the pooled sample, giving ties their average rank
+	pooled := append(append([]float64{}, x...), y...)
+	order := make([]int, len(pooled))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return pooled[order[a]] < pooled[order[b]] })
+	ranks := make([]float64, len(pooled))
+	var tieCorrection float64
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && pooled[order[j+1]] == pooled[order[i]] {
+			j++
+		}
+		for k := i; k <= j; k++ {
+			ranks[order[k]] = float64(i+j)/2 + 1
+		}
+		ties := float64(j - i + 1)
+		tieCorrection += ties*ties*ties - ties
+		i = j + 1
+	}
+
+	var rankSumX float64
+	for i := range x {
+		rankSumX += ranks[i]
+	}
+	u = rankSumX - nx*(nx+1)/2
+
+	mean := nx * ny / 2
+	n := nx + ny
+	sd := math.Sqrt(nx * ny / 12 * ((n + 1) - tieCorrection/(n*(n-1))))
+	if sd == 0 {
+		return u, 1
+	}
+	// Continuity correction towards the mean, as wilcox.test: z = (U - mean - sign(U - mean)/2) / sd
+	diff := u - mean
+	correction := 0.0
+	if diff > 0 {
+		correction = 0.5
+	} else if diff < 0 {
+		correction = -0.5
+	}
+	z := (diff - correction) / sd
+	pval = 2 * (1 - normalCDF(math.Abs(z)))
+	
+	return u, pval
+}
+
+// kolmogorovSmirnov performs the two sample Kolmogorov-Smirnov test. D is the largest distance between
+// the two empirical distribution functions. Like R's ks.test, the p-value is exact when the product of
+// the sample sizes is below 10000 and there are no ties; otherwise it is the asymptotic Kolmogorov
+// distribution at sqrt(nx * ny / (nx + ny)) * D, without a small sample correction, as in ks.test.
+// NaN values are dropped first, as ks.test drops NA.
+func kolmogorovSmirnov(x, y []float64) (d, pval float64) {
+	x, y = dropNaN(x), dropNaN(y)
+	if len(x) == 0 || len(y) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	xs := append([]float64{}, x...)
+	ys := append([]float64{}, y...)
+	sort.Float64s(xs)
+	sort.Float64s(ys)
+
+	// Walk both sorted samples, stepping over tied values together
+	nx := float64(len(xs))
+	ny := float64(len(ys))
+	i, j := 0, 0
+	ties := false
+	for i < len(xs) && j < len(ys) {
+		v := math.Min(xs[i], ys[j])
+		stepsX, stepsY := 0, 0
+		for i < len(xs) && xs[i] == v {
+			i++
+			stepsX++
+		}
+		for j < len(ys) && ys[j] == v {
+			j++
+			stepsY++
+		}
+		ties = ties || stepsX+stepsY > 1
+		d = math.Max(d, math.Abs(float64(i)/nx-float64(j)/ny))
+	}
+	ties = ties || hasTies(xs[i:]) || hasTies(ys[j:])
+
+	if nx*ny < 10000 && !ties {
+		return d, 1 - smirnovExact(d, len(xs), len(ys))
+	}
+	en := math.Sqrt(nx * ny / (nx + ny))
+	pval = kolmogorovSurvival(en * d)
+	
+	return d, pval
+}
+
+// dropNaN returns the values that are not NaN (correlations of genes without variance, for example)
+func dropNaN(values []float64) []float64 {
+	kept := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// hasTies reports whether a sorted sample repeats a value
+func hasTies(sorted []float64) bool {
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// smirnovExact returns P(D < d) for the two sample Kolmogorov-Smirnov statistic of samples of sizes m
+// and n without ties, counting the lattice paths that stay within d of the diagonal (psmirnov2x of
+// R's ks.test)
+func smirnovExact(d float64, m, n int) float64 {
+	if m > n {
+		m, n = n, m
+	}
+	md, nd := float64(m), float64(n)
+	q := (0.5 + math.Floor(d*md*nd-1e-7)) / (md * nd)
+	u := make([]float64, n+1)
+	for j := range u {
+		if float64(j)/nd <= q {
+			u[j] = 1
+		}
+	}
+	for i := 1; i <= m; i++ {
+		w := float64(i) / float64(i+n)
+		if float64(i)/md > q {
+			u[0] = 0
+		} else {
+			u[0] = w * u[0]
+		}
+		for j := 1; j <= n; j++ {
+			if math.Abs(float64(i)/md-float64(j)/nd) > q {
+				u[j] = 0
+			} else {
+				u[j] = w*u[j] + u[j-1]
+			}
+		}
+	}
+	return u[n]
+}
+
+// kolmogorovSurvival returns P(K > lambda) for the Kolmogorov distribution,
+// 2 * sum_{j >= 1} (-1)^(j-1) exp(-2 j^2 lambda^2)
+func kolmogorovSurvival(lambda float64) float64 {
+	if lambda < 1e-3 {
+		return 1
+	}
+	var sum float64
+	sign := 1.0
+	for j := 1; j <= 100; j++ {
+		term := sign * math.Exp(-2*float64(j*j)*lambda*lambda)
+		sum += term
+		if math.Abs(term) < 1e-12 {
+			break
+		}
+		sign = -sign
+	}
+	return math.Min(1, math.Max(0, 2*sum))
+}
+
 // normalCDF returns the cumulative distribution function of the standard normal distribution
 func normalCDF(x float64) float64 {
 	return 0.5 * (1 + math.Erf(x/math.Sqrt(2)))
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/stat"
+)
+
+// The two groups of R's sleep data set
+var (
+	sleep1 = []float64{0.7, -1.6, -0.2, -1.2, -0.1, 3.4, 3.7, 0.8, 0.0, 2.0}
+	sleep2 = []float64{1.9, 0.8, 1.1, 0.1, -0.1, 4.4, 5.5, 1.6, 4.6, 3.4}
+)
+
+func TestCalculateTTest(t *testing.T) {
+	// t.test(extra ~ group, data = sleep): t = -1.8608, df = 17.776, p-value = 0.07939
+	tstat, pval := calculateTTest(sleep1, sleep2)
+	if math.Abs(tstat-(-1.860813)) > 1e-6 {
+		t.Errorf("t = %v, want -1.860813", tstat)
+	}
+	if df := welchDF(sleep1, sleep2); math.Abs(df-17.77647) > 1e-5 {
+		t.Errorf("df = %v, want 17.77647", df)
+	}
+	if math.Abs(pval-0.07939) > 1e-5 {
+		t.Errorf("p = %v, want 0.07939", pval)
+	}
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	// wilcox.test(extra ~ group, data = sleep), with ties and the continuity correction:
+	// W = 25.5, p-value = 0.06933
+	u, pval := mannWhitneyU(sleep1, sleep2)
+	if u != 25.5 {
+		t.Errorf("U = %v, want 25.5", u)
+	}
+	if math.Abs(pval-0.06933) > 1e-5 {
+		t.Errorf("p = %v, want 0.06933", pval)
+	}
+
+	// U at its mean gives p = 1
+	if _, pval := mannWhitneyU([]float64{1, 4}, []float64{2, 3}); pval != 1 {
+		t.Errorf("p = %v for U at its mean, want 1", pval)
+	}
+}
+
+func TestKolmogorovSmirnov(t *testing.T) {
+	// Samples of 9 with D = 6/9. For m = n the exact p-value is
+	// 2 * sum_k (-1)^(k+1) choose(2n, n - k*6) / choose(2n, n) = 2 * choose(18, 3) / choose(18, 9)
+	x := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	y := []float64{6.5, 7.5, 8.5, 9.5, 10.5, 11.5, 12.5, 13.5, 14.5}
+	d, pval := kolmogorovSmirnov(x, y)
+	if math.Abs(d-6.0/9) > 1e-12 {
+		t.Errorf("D = %v, want 6/9", d)
+	}
+	if want := 2 * 816.0 / 48620; math.Abs(pval-want) > 1e-10 {
+		t.Errorf("p = %v, want the exact %v", pval, want)
+	}
+
+	// With nx * ny = 10000 the p-value is asymptotic: D = 1/2 and sqrt(100 * 100 / 200) * D = sqrt(12.5),
+	// so p = 2 * exp(-2 * 12.5) up to terms of exp(-100)
+	var large1, large2 []float64
+	for i := 1; i <= 100; i++ {
+		large1 = append(large1, float64(i))
+		large2 = append(large2, float64(i+50))
+	}
+	d, pval = kolmogorovSmirnov(large1, large2)
+	if want := 2 * math.Exp(-25); d != 0.5 || math.Abs(pval-want) > 1e-20 {
+		t.Errorf("D = %v, p = %v, want 0.5 and %v", d, pval, want)
+	}
+
+	// Identical samples are as close as can be
+	if d, pval := kolmogorovSmirnov(x, x); d != 0 || pval != 1 {
+		t.Errorf("D = %v, p = %v for identical samples, want 0 and 1", d, pval)
+	}
+}
+
+func TestTestsDropNaN(t *testing.T) {
+	// NaN at the start and in the middle of the sample
+	withNaN := func(values []float64) []float64 {
+		mixed := append([]float64{math.NaN()}, values[:5]...)
+		mixed = append(mixed, math.NaN())
+		return append(mixed, values[5:]...)
+	}
+	x, y := withNaN(sleep1), withNaN(sleep2)
+
+	tests := []struct {
+		name string
+		test func(x, y []float64) (float64, float64)
+	}{
+		{"welch", calculateTTest},
+		{"mannwhitney", mannWhitneyU},
+		{"ks", kolmogorovSmirnov},
+	}
+	for _, tt := range tests {
+		wantStatistic, wantP := tt.test(sleep1, sleep2)
+		statistic, p := tt.test(x, y)
+		if statistic != wantStatistic || p != wantP {
+			t.Errorf("%s with NaN values = %v, %v; want %v, %v", tt.name, statistic, p, wantStatistic, wantP)
+		}
+		if statistic, p := tt.test([]float64{math.NaN()}, sleep2); !math.IsNaN(statistic) || !math.IsNaN(p) {
+			t.Errorf("%s of an all NaN sample = %v, %v; want NaN", tt.name, statistic, p)
+		}
+	}
+}
+
+func TestKolmogorovSurvival(t *testing.T) {
+	// 1.3581 is the 5% critical value of the Kolmogorov distribution
+	if p := kolmogorovSurvival(1.3581); math.Abs(p-0.05) > 1e-4 {
+		t.Errorf("P(K > 1.3581) = %v, want 0.05", p)
+	}
+}
+
+func TestConditionFiles(t *testing.T) {
+	var files conditionFiles
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&files, "condition", "condition file")
+	if err := fs.Parse([]string{"-condition", "AML=a.csv", "-condition", "b.csv"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != "AML=a.csv" || files[1] != "b.csv" {
+		t.Errorf("conditions = %v, want every -condition in order", files)
+	}
+	if s := files.String(); s != "AML=a.csv, b.csv" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Conditions) != 2 || opts.Test != "welch" || opts.Adjust != "BH" || opts.Balance != 0 || opts.Seed != 1 {
+		t.Errorf("defaults = %+v", opts)
+	}
+
+	opts, err = parseOptions([]string{"-condition", "a=x.csv", "-condition", "y.tsv", "-condition", "z.csv",
+		"-test", "ks", "-balance", "20", "-seed", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Conditions) != 3 || opts.Conditions[1] != "y.tsv" || opts.Test != "ks" || opts.Balance != 20 || opts.Seed != 0 {
+		t.Errorf("options = %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{"-condition", "only.csv"},
+		{"-test", "anova"},
+		{"-balance", "-1"},
+	} {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("parseOptions(%v) gave no error", args)
+		}
+	}
+}
+
+func TestConditionName(t *testing.T) {
+	for _, tt := range []struct {
+		value, name, path string
+	}{
+		{"AML=data/golub/aml_samples.csv", "AML", "data/golub/aml_samples.csv"},
+		{"data/golub/all_samples.csv", "all_samples", "data/golub/all_samples.csv"},
+		{"treated=runs/a=b.csv", "treated", "runs/a=b.csv"},
+	} {
+		if name, path := conditionName(tt.value); name != tt.name || path != tt.path {
+			t.Errorf("conditionName(%q) = %q, %q; want %q, %q", tt.value, name, path, tt.name, tt.path)
+		}
+	}
+}
+
+func TestIsHeader(t *testing.T) {
+	if !isHeader([]string{"", "sample1", "sample2"}) {
+		t.Errorf("sample names not taken as a header")
+	}
+	if isHeader([]string{"gene1", "0.5", "1.2"}) {
+		t.Errorf("expression values taken as a header")
+	}
+	if isHeader([]string{"gene1", "NA", "1.2"}) {
+		t.Errorf("a row with a missing value taken as a header")
+	}
+	if isHeader([]string{"gene1", "NA", "NA"}) {
+		t.Errorf("a row of missing values taken as a header")
+	}
+}
+
+// writeExpressionFile writes lines to a CSV file in a temporary directory and returns its path
+func writeExpressionFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "expression.csv")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadExpressionDataKeepsMissingValues(t *testing.T) {
+	path := writeExpressionFile(t,
+		`"",s1,s2,s3,s4`,
+		"g1,1,NA,3,4",
+		"g2,2,4,,8",
+		"g3,1,3,2,5",
+	)
+	data, err := loadExpressionData(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sampleCount(data); n != 4 {
+		t.Fatalf("sampleCount = %d, want 4", n)
+	}
+	if g1 := data["g1"]; len(g1) != 4 || !math.IsNaN(g1[1]) || g1[3] != 4 {
+		t.Errorf("g1 = %v, want [1 NaN 3 4]", g1)
+	}
+
+	// g1 and g2 are only both present in samples 1 and 4, where they rise together
+	moduleMap := map[string]string{"g1": "blue", "g2": "blue"}
+	corrs := getModuleCorrelations([]string{"g1", "g2"}, data, nil)
+	if len(corrs) != 1 || math.Abs(corrs[0]-1) > 1e-12 {
+		t.Errorf("correlations = %v, want [1]", corrs)
+	}
+	if stats := analyzeModule("blue", moduleMap, data, data, nil, nil, "welch"); stats.Size != 2 {
+		t.Errorf("module size = %d, want 2", stats.Size)
+	}
+
+	// g1 and g3 share samples 1, 3 and 4
+	corrs = getModuleCorrelations([]string{"g1", "g3"}, data, nil)
+	want := stat.Correlation([]float64{1, 3, 4}, []float64{1, 2, 5}, nil)
+	if len(corrs) != 1 || math.Abs(corrs[0]-want) > 1e-12 {
+		t.Errorf("correlations = %v, want [%v]", corrs, want)
+	}
+}
+
+func TestLoadExpressionDataRejectsBadValues(t *testing.T) {
+	_, err := loadExpressionData(writeExpressionFile(t, "g1,1,2,3", "g2,1,x,3"))
+	if err == nil || !strings.Contains(err.Error(), "g2") || !strings.Contains(err.Error(), "column 3") {
+		t.Errorf("error = %v, want one naming gene g2 and column 3", err)
+	}
+
+	// A short row would shift the samples of that gene
+	if _, err := loadExpressionData(writeExpressionFile(t, "g1,1,2,3", "g2,1,2")); err == nil {
+		t.Errorf("expected an error for a row with a missing field")
+	}
+}
+
+func TestMedian(t *testing.T) {
+	if m := median([]float64{3, 1, 2}); m != 2 {
+		t.Errorf("median = %v, want 2", m)
+	}
+	if m := median([]float64{4, 1, 3, 2}); m != 2.5 {
+		t.Errorf("median = %v, want 2.5", m)
+	}
+	if m := median([]float64{1, math.NaN(), 3}); !math.IsNaN(m) {
+		t.Errorf("median = %v, want NaN", m)
+	}
+}
+
+func TestBalancedSamples(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	samples1, samples2 := balancedSamples(10, 4, 4, rng)
+	if len(samples1) != 4 || len(samples2) != 4 {
+		t.Fatalf("drew %d and %d samples, want 4 of each", len(samples1), len(samples2))
+	}
+	sorted := append([]int{}, samples1...)
+	sort.Ints(sorted)
+	for i, s := range sorted {
+		if s < 0 || s >= 10 || (i > 0 && s == sorted[i-1]) {
+			t.Fatalf("samples %v are not 4 distinct samples out of 10", samples1)
+		}
+	}
+	sort.Ints(samples2)
+	for i, s := range samples2 {
+		if s != i {
+			t.Fatalf("samples %v, want every sample of the smaller condition", samples2)
+		}
+	}
+}
+
+func TestAnalyzeModuleBalancedEqualSizes(t *testing.T) {
+	// With conditions of equal size every draw holds all samples, so the draws agree with analyzeModule
+	rng := rand.New(rand.NewSource(1))
+	moduleMap := map[string]string{"g1": "blue", "g2": "blue", "g3": "blue", "g4": "blue"}
+	makeCondition := func(name string) condition {
+		data := make(map[string][]float64)
+		for gene := range moduleMap {
+			values := make([]float64, 8)
+			for i := range values {
+				values[i] = rng.NormFloat64()
+			}
+			data[gene] = values
+		}
+		return condition{Name: name, Data: data, Samples: 8}
+	}
+	c1, c2 := makeCondition("a"), makeCondition("b")
+
+	want := analyzeModule("blue", moduleMap, c1.Data, c2.Data, nil, nil, "mannwhitney")
+	got := analyzeModuleBalanced("blue", moduleMap, c1, c2, "mannwhitney", 5, rand.New(rand.NewSource(2)))
+	if got.Statistic != want.Statistic || got.PValue != want.PValue || got.Size != 4 {
+		t.Errorf("balanced = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+// Package multipletesting corrects p-values for multiple testing. It is shared by the module comparison
+// tool, the DiffCoEx tool and the null distribution test.
+package multipletesting
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Methods are the multiple testing corrections understood by Adjust
+var Methods = []string{"none", "bonferroni", "holm", "BH", "BY", "qvalue"}
+
+// storeyLambda is the tuning parameter of Storey's estimate of the proportion of true null hypotheses
+const storeyLambda = 0.5
+
+// Adjust corrects p-values for multiple testing like R's p.adjust:
+//
+//	bonferroni, holm: family-wise error rate
+//	BH (Benjamini-Hochberg), BY (Benjamini-Yekutieli, valid under any dependence): false discovery rate
+//	qvalue: Storey's q-values, BH scaled by the estimated proportion of true null hypotheses
+//
+// NaN p-values are left out of the family and stay NaN, as NA does in R.
+func Adjust(p []float64, method string) ([]float64, error) {
+	// Keep the tested p-values, sorted in increasing order
+	var order []int
+	for i, v := range p {
+		if !math.IsNaN(v) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return p[order[a]] < p[order[b]] })
+	m := float64(len(order))
+
+	adjusted := make([]float64, len(p))
+	for i := range adjusted {
+		adjusted[i] = math.NaN()
+	}
+
+	switch method {
+	case "none":
+		for _, i := range order {
+			adjusted[i] = p[i]
+		}
+
+	case "bonferroni":
+		for _, i := range order {
+			adjusted[i] = math.Min(1, m*p[i])
+		}
+
+	case "holm":
+		// Step down: (m - rank + 1) * p, made non-decreasing from the smallest p-value up
+		running := 0.0
+		for rank, i := range order {
+			running = math.Max(running, (m-float64(rank))*p[i])
+			adjusted[i] = math.Min(1, running)
+		}
+
+	case "BH", "BY", "qvalue":
+		scale := 1.0
+		switch method {
+		case "BY":
+			for k := 1; k <= len(order); k++ {
+				scale += 1 / float64(k)
+			}
+			scale--
+		case "qvalue":
+			scale = storeyPi0(p, order)
+		}
+		// Step up: m / rank * p, made non-increasing from the largest p-value down
+		running := math.Inf(1)
+		for rank := len(order) - 1; rank >= 0; rank-- {
+			i := order[rank]
+			running = math.Min(running, scale*m/float64(rank+1)*p[i])
+			adjusted[i] = math.Min(1, running)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown p-value adjustment %q (use %s)", method, strings.Join(Methods, ", "))
+	}
+	return adjusted, nil
+}
+
+// storeyPi0 estimates the proportion of true null hypotheses from the p-values above storeyLambda,
+// (1 + #{p > lambda}) / (m (1 - lambda)) as in Storey, Taylor and Siegmund (2004), capped at 1
+func storeyPi0(p []float64, order []int) float64 {
+	above := 0
+	for _, i := range order {
+		if p[i] > storeyLambda {
+			above++
+		}
+	}
+	return math.Min(1, float64(above+1)/(float64(len(order))*(1-storeyLambda)))
+}
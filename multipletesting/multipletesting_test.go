@@ -0,0 +1,44 @@
+package multipletesting
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAdjustMatchesPAdjust(t *testing.T) {
+	// p.adjust(p, method) in R; the input is shuffled to check that the order is kept
+	p := []float64{0.042, 0.001, 0.216, 0.039, 0.06, 0.008, 0.205, 0.074, 0.041, 0.212}
+	tests := map[string][]float64{
+		"BH":         {0.084, 0.01, 0.216, 0.084, 0.1, 0.04, 0.216, 0.1057142857142857, 0.084, 0.216},
+		"BY":         {0.2460333333333333, 0.02928968253968254, 0.6326571428571428, 0.2460333333333333, 0.2928968253968254, 0.11715873015873016, 0.6326571428571428, 0.3096337868480725, 0.2460333333333333, 0.6326571428571428},
+		"holm":       {0.312, 0.01, 0.615, 0.312, 0.312, 0.072, 0.615, 0.312, 0.312, 0.615},
+		"bonferroni": {0.42, 0.01, 1, 0.39, 0.6, 0.08, 1, 0.74, 0.41, 1},
+		// No p-value above 0.5, so pi0 = 1 / (10 * 0.5)
+		"qvalue": {0.0168, 0.002, 0.0432, 0.0168, 0.02, 0.008, 0.0432, 0.021142857142857144, 0.0168, 0.0432},
+	}
+	for method, want := range tests {
+		got, err := Adjust(p, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-12 {
+				t.Errorf("%s: got %v, want %v", method, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestAdjustSkipsNaN(t *testing.T) {
+	got, err := Adjust([]float64{0.01, math.NaN(), 0.04}, "bonferroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 0.02 || !math.IsNaN(got[1]) || got[2] != 0.08 {
+		t.Errorf("got %v, want [0.02 NaN 0.08]", got)
+	}
+	if _, err := Adjust(got, "fdr2"); err == nil {
+		t.Error("unknown method accepted")
+	}
+}